@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
 )
 
 // AllocationResult contains a net.IP / Interface pair
@@ -20,6 +22,7 @@ type AllocationResult struct {
 type AllocateClient interface {
 	AllocateIPsOn(intf Interface, batchSize int64) ([]*AllocationResult, error)
 	AllocateIPsFirstAvailableAtIndex(index int, batchSize int64) ([]*AllocationResult, error)
+	AllocateIPsFirstAvailableMatching(index int, batchSize int64, filter InterfaceFilter) ([]*AllocationResult, error)
 	AllocateIPsFirstAvailable(batchSize int64) ([]*AllocationResult, error)
 	DeallocateIP(ipToRelease *net.IP) error
 }
@@ -29,8 +32,22 @@ type allocateClient struct {
 	subnet SubnetsClient
 }
 
-// AllocateIPsOn allocates IPs on a specific interface.
-func (c *allocateClient) AllocateIPsOn(intf Interface, batchSize int64) ([]*AllocationResult, error) {
+// AllocateIPsOn allocates IPs on a specific interface. Allocations on an
+// interface are serialized, as new IPs are told apart by comparing the
+// IPs of the interface before and after.
+func (c *allocateClient) AllocateIPsOn(intf Interface, batchSize int64) (results []*AllocationResult, err error) {
+	err = lib.WithLockTimeout(lib.InterfaceLock(intf.ID), func() error {
+		// Another process may have allocated on the interface meanwhile
+		if current, err := c.aws.getInterface(intf.Mac); err == nil {
+			intf = current
+		}
+		results, err = c.allocateIPsOn(intf, batchSize)
+		return err
+	})
+	return
+}
+
+func (c *allocateClient) allocateIPsOn(intf Interface, batchSize int64) ([]*AllocationResult, error) {
 	var allocationResults []*AllocationResult
 	client, err := c.aws.newEC2()
 	if err != nil {
@@ -104,9 +121,18 @@ func (c *allocateClient) AllocateIPsOn(intf Interface, batchSize int64) ([]*Allo
 	return nil, fmt.Errorf("Can't locate new IP address from AWS")
 }
 
+// InterfaceFilter selects the interfaces IPs may be allocated on
+type InterfaceFilter func(intf Interface) bool
+
 // AllocateIPsFirstAvailableAtIndex allocates IP addresses, skipping any adapter < the given index
 // Returns a reference to the interface the IPs were allocated on
 func (c *allocateClient) AllocateIPsFirstAvailableAtIndex(index int, batchSize int64) ([]*AllocationResult, error) {
+	return c.AllocateIPsFirstAvailableMatching(index, batchSize, nil)
+}
+
+// AllocateIPsFirstAvailableMatching allocates IP addresses on the first
+// available adapter at or above the given index which matches filter, if any
+func (c *allocateClient) AllocateIPsFirstAvailableMatching(index int, batchSize int64, filter InterfaceFilter) ([]*AllocationResult, error) {
 	interfaces, err := c.aws.GetInterfaces()
 	if err != nil {
 		return nil, err
@@ -118,7 +144,7 @@ func (c *allocateClient) AllocateIPsFirstAvailableAtIndex(index int, batchSize i
 
 	var candidates []Interface
 	for _, intf := range interfaces {
-		if intf.Number < index {
+		if intf.Number < index || (filter != nil && !filter(intf)) {
 			continue
 		}
 		if int64(len(intf.IPv4s)) < limits.IPv4 {
@@ -169,8 +195,10 @@ func (c *allocateClient) DeallocateIP(ipToRelease *net.IP) error {
 				request.SetNetworkInterfaceId(intf.ID)
 				strIP := ipToRelease.String()
 				request.SetPrivateIpAddresses([]*string{&strIP})
-				_, err = client.UnassignPrivateIpAddresses(&request)
-				return err
+				return lib.WithLockTimeout(lib.InterfaceLock(intf.ID), func() error {
+					_, err := client.UnassignPrivateIpAddresses(&request)
+					return err
+				})
 			}
 		}
 	}
@@ -2,7 +2,6 @@ package cache
 
 import (
 	"encoding/json"
-	"fmt"
 	"os"
 	"path"
 	"time"
@@ -10,10 +9,7 @@ import (
 	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
 )
 
-const (
-	cacheRoot    = "/run"
-	cacheProgram = "cni-ipvlan-vpc-k8s"
-)
+const cacheDir = "cache"
 
 // State defines the return of the Store and Get calls
 type State int
@@ -29,13 +25,9 @@ const (
 	CacheNotAvailable
 )
 
+// cachePath is the cache directory within the plugin state directory
 func cachePath() string {
-	uid := os.Getuid()
-	if uid != 0 {
-		return path.Join(cacheRoot, "user", fmt.Sprintf("%d", os.Getuid()), cacheProgram)
-	}
-
-	return path.Join(cacheRoot, cacheProgram)
+	return path.Join(lib.StatePath(), cacheDir)
 }
 
 // Cacheable defines metadata for objects which can be cached to files as JSON
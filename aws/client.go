@@ -28,6 +28,7 @@ type combinedClient struct {
 	*interfaceClient
 	*allocateClient
 	*vpcCacheClient
+	*addressClient
 }
 
 // Client offers all of the supporting AWS services
@@ -38,6 +39,7 @@ type Client interface {
 	SubnetsClient
 	AllocateClient
 	VPCClient
+	AddressClient
 }
 
 var defaultClient *combinedClient
@@ -60,6 +62,7 @@ func init() {
 			&vpcclient{awsClient},
 			1 * time.Hour,
 		},
+		&addressClient{awsClient},
 	}
 
 	DefaultClient = defaultClient
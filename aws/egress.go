@@ -0,0 +1,127 @@
+package aws
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
+)
+
+// AllocateEgressIP assigns a new secondary private IP on the boot ENI and
+// records it as the egress IP of a namespace. If allocationID is given,
+// the Elastic IP is associated with the new private IP.
+func AllocateEgressIP(namespace string, allocationID string) (*lib.EgressIP, error) {
+	interfaces, err := DefaultClient.GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	if len(interfaces) == 0 {
+		return nil, fmt.Errorf("no boot interface found")
+	}
+	// Interfaces are sorted by device number. The first one is the boot ENI
+	boot := interfaces[0]
+
+	allocs, err := DefaultClient.AllocateIPsOn(boot, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(allocs) == 0 {
+		return nil, fmt.Errorf("no IP allocated on %v", boot.ID)
+	}
+
+	egress := &lib.EgressIP{
+		Namespace:   namespace,
+		IP:          *allocs[0].IP,
+		InterfaceID: boot.ID,
+	}
+
+	// Egress IPs are never free for Pods, keep them out of the registry
+	registry := &Registry{}
+	if err := registry.ForgetIP(egress.IP); err != nil {
+		rollbackEgressIP(egress)
+		return nil, err
+	}
+
+	if err := associateEgressIP(egress, allocationID); err != nil {
+		rollbackEgressIP(egress)
+		return nil, err
+	}
+
+	egressIPs := &lib.EgressIPs{}
+	if err := egressIPs.Set(egress); err != nil {
+		rollbackEgressIP(egress)
+		return nil, err
+	}
+	return egress, nil
+}
+
+// associateEgressIP associates the Elastic IP allocationID, if given,
+// with an egress IP
+func associateEgressIP(egress *lib.EgressIP, allocationID string) error {
+	if allocationID == "" {
+		return nil
+	}
+	eip, err := DefaultClient.DescribeAddress(allocationID)
+	if err != nil {
+		return err
+	}
+	associationID, err := DefaultClient.AssociateAddress(allocationID, egress.InterfaceID, egress.IP)
+	if err != nil {
+		return err
+	}
+	egress.AllocationID = allocationID
+	egress.PublicIP = eip.PublicIP
+	egress.AssociationID = associationID
+	return nil
+}
+
+// rollbackEgressIP returns an egress IP which could not be recorded to
+// AWS, so it does not linger on the boot ENI where it could be handed to
+// a Pod. Failures are only reported, as the caller fails anyway.
+func rollbackEgressIP(egress *lib.EgressIP) {
+	if egress.AssociationID != "" {
+		if err := DefaultClient.DisassociateAddress(egress.AssociationID); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to disassociate Elastic IP from %v due to %v\n", egress.IP, err)
+		}
+	}
+	if err := DefaultClient.DeallocateIP(&egress.IP); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to deallocate egress IP %v due to %v\n", egress.IP, err)
+	}
+}
+
+// ReassociateEgressIP replaces the Elastic IP associated with an egress IP
+// by allocationID, or only disassociates it if allocationID is empty. The
+// private IP running Pods are SNATed to is kept.
+func ReassociateEgressIP(egress *lib.EgressIP, allocationID string) error {
+	if egress.AssociationID != "" {
+		if err := DefaultClient.DisassociateAddress(egress.AssociationID); err != nil {
+			return err
+		}
+		egress.AllocationID = ""
+		egress.AssociationID = ""
+		egress.PublicIP = nil
+	}
+
+	err := associateEgressIP(egress, allocationID)
+	if setErr := (&lib.EgressIPs{}).Set(egress); err == nil {
+		err = setErr
+	}
+	return err
+}
+
+// ReleaseEgressIP disassociates any Elastic IP from an egress IP, returns
+// the private IP to AWS and forgets the namespace's egress IP
+func ReleaseEgressIP(egress *lib.EgressIP) error {
+	if egress.AssociationID != "" {
+		if err := DefaultClient.DisassociateAddress(egress.AssociationID); err != nil {
+			return err
+		}
+	}
+
+	if err := DefaultClient.DeallocateIP(&egress.IP); err != nil {
+		return err
+	}
+
+	egressIPs := &lib.EgressIPs{}
+	return egressIPs.Remove(egress.Namespace)
+}
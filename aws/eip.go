@@ -0,0 +1,180 @@
+package aws
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// ElasticIP describes an Elastic IP address
+type ElasticIP struct {
+	AllocationID       string
+	PublicIP           net.IP
+	AssociationID      string
+	NetworkInterfaceID string
+	PrivateIP          net.IP
+	Tags               map[string]string
+}
+
+// AddressClient provides methods for managing Elastic IPs
+type AddressClient interface {
+	DescribeAddress(allocationID string) (*ElasticIP, error)
+	AssociateAddress(allocationID string, interfaceID string, privateIP net.IP) (string, error)
+	DisassociateAddress(associationID string) error
+	DescribeAddressesByTags(tags map[string]string) ([]*ElasticIP, error)
+	DescribeAddressesOn(interfaceID string, privateIP net.IP) ([]*ElasticIP, error)
+	AllocateAddress(tags map[string]string) (*ElasticIP, error)
+}
+
+type addressClient struct {
+	aws awsAddressClient
+}
+
+type awsAddressClient interface {
+	newEC2() (ec2iface.EC2API, error)
+}
+
+func elasticIPFromAddress(address *ec2.Address) *ElasticIP {
+	eip := &ElasticIP{
+		AllocationID:       aws.StringValue(address.AllocationId),
+		PublicIP:           net.ParseIP(aws.StringValue(address.PublicIp)),
+		AssociationID:      aws.StringValue(address.AssociationId),
+		NetworkInterfaceID: aws.StringValue(address.NetworkInterfaceId),
+		PrivateIP:          net.ParseIP(aws.StringValue(address.PrivateIpAddress)),
+		Tags:               map[string]string{},
+	}
+	for _, tag := range address.Tags {
+		eip.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return eip
+}
+
+// DescribeAddress returns the Elastic IP with the given allocation ID
+func (c *addressClient) DescribeAddress(allocationID string) (*ElasticIP, error) {
+	client, err := c.aws.newEC2()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.DescribeAddresses(&ec2.DescribeAddressesInput{
+		AllocationIds: []*string{aws.String(allocationID)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Addresses) == 0 {
+		return nil, fmt.Errorf("Elastic IP %v not found", allocationID)
+	}
+	return elasticIPFromAddress(res.Addresses[0]), nil
+}
+
+func (c *addressClient) describeAddresses(filters []*ec2.Filter) ([]*ElasticIP, error) {
+	client, err := c.aws.newEC2()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.DescribeAddresses(&ec2.DescribeAddressesInput{
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var eips []*ElasticIP
+	for _, address := range res.Addresses {
+		eips = append(eips, elasticIPFromAddress(address))
+	}
+	return eips, nil
+}
+
+// DescribeAddressesByTags returns the VPC Elastic IPs carrying all of
+// the given tags
+func (c *addressClient) DescribeAddressesByTags(tags map[string]string) ([]*ElasticIP, error) {
+	filters := []*ec2.Filter{newEc2Filter("domain", "vpc")}
+	for k, v := range tags {
+		filters = append(filters, newEc2Filter(fmt.Sprintf("tag:%s", k), v))
+	}
+	return c.describeAddresses(filters)
+}
+
+// DescribeAddressesOn returns the Elastic IPs associated with a private
+// IP of an interface
+func (c *addressClient) DescribeAddressesOn(interfaceID string, privateIP net.IP) ([]*ElasticIP, error) {
+	return c.describeAddresses([]*ec2.Filter{
+		newEc2Filter("network-interface-id", interfaceID),
+		newEc2Filter("private-ip-address", privateIP.String()),
+	})
+}
+
+// AllocateAddress allocates a new VPC Elastic IP and tags it
+func (c *addressClient) AllocateAddress(tags map[string]string) (*ElasticIP, error) {
+	client, err := c.aws.newEC2()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.AllocateAddress(&ec2.AllocateAddressInput{
+		Domain: aws.String(ec2.DomainTypeVpc),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	eip := &ElasticIP{
+		AllocationID: aws.StringValue(res.AllocationId),
+		PublicIP:     net.ParseIP(aws.StringValue(res.PublicIp)),
+		Tags:         tags,
+	}
+
+	if len(tags) > 0 {
+		input := &ec2.CreateTagsInput{
+			Resources: []*string{res.AllocationId},
+		}
+		for k, v := range tags {
+			input.Tags = append(input.Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		if _, err = client.CreateTags(input); err != nil {
+			return nil, err
+		}
+	}
+	return eip, nil
+}
+
+// AssociateAddress associates an Elastic IP with a private IP of an
+// interface, returning the association ID. An Elastic IP already
+// associated elsewhere is never taken over.
+func (c *addressClient) AssociateAddress(allocationID string, interfaceID string, privateIP net.IP) (string, error) {
+	client, err := c.aws.newEC2()
+	if err != nil {
+		return "", err
+	}
+
+	req := &ec2.AssociateAddressInput{
+		AllocationId:       aws.String(allocationID),
+		NetworkInterfaceId: aws.String(interfaceID),
+		PrivateIpAddress:   aws.String(privateIP.String()),
+		AllowReassociation: aws.Bool(false),
+	}
+	res, err := client.AssociateAddress(req)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(res.AssociationId), nil
+}
+
+// DisassociateAddress removes an Elastic IP association
+func (c *addressClient) DisassociateAddress(associationID string) error {
+	client, err := c.aws.newEC2()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.DisassociateAddress(&ec2.DisassociateAddressInput{
+		AssociationId: aws.String(associationID),
+	})
+	return err
+}
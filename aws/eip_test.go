@@ -0,0 +1,87 @@
+package aws
+
+import (
+	"net"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+type ec2AddressesMock struct {
+	ec2iface.EC2API
+	Resp    ec2.DescribeAddressesOutput
+	Filters []*ec2.Filter
+	Tags    []*ec2.Tag
+}
+
+func (e *ec2AddressesMock) DescribeAddresses(in *ec2.DescribeAddressesInput) (*ec2.DescribeAddressesOutput, error) {
+	e.Filters = in.Filters
+	return &e.Resp, nil
+}
+
+func (e *ec2AddressesMock) AllocateAddress(in *ec2.AllocateAddressInput) (*ec2.AllocateAddressOutput, error) {
+	return &ec2.AllocateAddressOutput{
+		AllocationId: aws.String("eipalloc-5678"),
+		PublicIp:     aws.String("203.0.113.20"),
+		Domain:       in.Domain,
+	}, nil
+}
+
+func (e *ec2AddressesMock) CreateTags(in *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	e.Tags = in.Tags
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func TestDescribeAddressesByTags(t *testing.T) {
+	mock := &ec2AddressesMock{
+		Resp: ec2.DescribeAddressesOutput{
+			Addresses: []*ec2.Address{
+				{
+					AllocationId: aws.String("eipalloc-1234"),
+					PublicIp:     aws.String("203.0.113.10"),
+					Tags: []*ec2.Tag{
+						{Key: aws.String("pool"), Value: aws.String("ingress")},
+					},
+				},
+			},
+		},
+	}
+	client := &addressClient{aws: awsSubnetClientMock{EC2Client: mock}}
+
+	eips, err := client.DescribeAddressesByTags(map[string]string{"pool": "ingress"})
+	if err != nil {
+		t.Fatalf("Error returned %v", err)
+	}
+	if len(eips) != 1 || !eips[0].PublicIP.Equal(net.ParseIP("203.0.113.10")) {
+		t.Errorf("Invalid addresses returned %v", eips)
+	}
+	if eips[0].AssociationID != "" || eips[0].Tags["pool"] != "ingress" {
+		t.Errorf("Invalid address %v", eips[0])
+	}
+
+	filters := map[string]string{}
+	for _, filter := range mock.Filters {
+		filters[aws.StringValue(filter.Name)] = aws.StringValue(filter.Values[0])
+	}
+	if filters["domain"] != "vpc" || filters["tag:pool"] != "ingress" {
+		t.Errorf("Invalid filters %v", mock.Filters)
+	}
+}
+
+func TestAllocateAddress(t *testing.T) {
+	mock := &ec2AddressesMock{}
+	client := &addressClient{aws: awsSubnetClientMock{EC2Client: mock}}
+
+	eip, err := client.AllocateAddress(map[string]string{"pool": "ingress"})
+	if err != nil {
+		t.Fatalf("Error returned %v", err)
+	}
+	if eip.AllocationID != "eipalloc-5678" || !eip.PublicIP.Equal(net.ParseIP("203.0.113.20")) {
+		t.Errorf("Invalid address allocated %v", eip)
+	}
+	if len(mock.Tags) != 1 || aws.StringValue(mock.Tags[0].Key) != "pool" {
+		t.Errorf("Address not tagged into the pool %v", mock.Tags)
+	}
+}
@@ -1,14 +1,27 @@
 package aws
 
 import (
+	"net"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
 	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
 
+// ReconcileInterval is how often the in-use IPs recorded by the IPAM
+// plugin are reconciled with a scan of the network namespaces on the host
+var ReconcileInterval = 5 * time.Minute
+
+// reconcileGrace is how long an IP handed out by ADD is considered in use
+// without being seen by a namespace scan, until its Pod is configured
+const reconcileGrace = 2 * time.Minute
+
 // FindFreeIPsAtIndex locates free IP addresses by comparing the assigned list
 // from the EC2 metadata service and the currently used addresses
 // within netlink. This is inherently somewhat racey - for example
 // newly provisioned addresses may not show up immediately in metadata
-// and are subject to a few seconds of delay.
+// and are subject to a few seconds of delay. IPs in Pod namespaces are
+// taken from the in-use inventory, reconciled every ReconcileInterval.
 func FindFreeIPsAtIndex(index int, updateRegistry bool) ([]*AllocationResult, error) {
 	freeIps := []*AllocationResult{}
 	registry := &Registry{}
@@ -17,23 +30,30 @@ func FindFreeIPsAtIndex(index int, updateRegistry bool) ([]*AllocationResult, er
 	if err != nil {
 		return nil, err
 	}
-	assigned, err := nl.GetIPs()
+	assigned, err := assignedIPs(interfaces)
+	if err != nil {
+		return nil, err
+	}
+	// Egress IPs are assigned to namespaces, not Pods
+	egressIPs, err := (&lib.EgressIPs{}).List()
 	if err != nil {
 		return nil, err
 	}
+	reserved := make(map[string]bool)
+	for _, egress := range egressIPs {
+		reserved[egress.IP.String()] = true
+	}
 
+	observed := []ObservedIP{}
 	for _, intf := range interfaces {
 		if intf.Number < index {
 			continue
 		}
 		for _, intfIP := range intf.IPv4s {
-			found := false
-			for _, assignedIP := range assigned {
-				if assignedIP.IPNet.IP.Equal(intfIP) {
-					found = true
-					break
-				}
+			if reserved[intfIP.String()] {
+				continue
 			}
+			found := assigned[intfIP.String()]
 			if !found {
 				intfIPCopy := intfIP
 				// No match, record as free
@@ -42,23 +62,117 @@ func FindFreeIPsAtIndex(index int, updateRegistry bool) ([]*AllocationResult, er
 					intf,
 				})
 			}
-			if updateRegistry {
-				if exists, err := registry.HasIP(intfIP); err == nil && !exists && !found {
-					// track IP as free if it hasn't been registered before
-					err = registry.TrackIP(intfIP)
-					if err != nil {
-						return freeIps, err
-					}
-				} else if found {
-					// mark IP as in use
-					err = registry.ForgetIP(intfIP)
-					if err != nil {
-						return freeIps, err
-					}
-				}
-			}
+			observed = append(observed, ObservedIP{
+				IP:        intfIP,
+				Interface: intf,
+				InUse:     found,
+			})
+		}
+	}
+
+	if updateRegistry {
+		// track IPs as free if they haven't been registered before, and
+		// as in use when found
+		if err := registry.ObserveIPs(observed); err != nil {
+			return freeIps, err
 		}
 	}
 
 	return freeIps, nil
 }
+
+// assignedIPs returns the IPs of interfaces which are in use, either on
+// the host or in the in-use inventory of Pod namespaces
+func assignedIPs(interfaces []Interface) (map[string]bool, error) {
+	assigned := make(map[string]bool)
+	hostIPs, err := nl.GetHostIPs()
+	if err != nil {
+		return nil, err
+	}
+	for _, hostIP := range hostIPs {
+		assigned[hostIP.IP.String()] = true
+	}
+
+	inUse, err := (&lib.InUseIPs{}).Reconciled(ReconcileInterval, reconcileGrace, func() ([]net.IP, int, error) {
+		return scanInterfaceIPs(interfaces)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range inUse {
+		assigned[ip.String()] = true
+	}
+	return assigned, nil
+}
+
+// scanInterfaceIPs returns the IPs of interfaces found in the network
+// namespaces on the host, and how many namespaces were scanned
+func scanInterfaceIPs(interfaces []Interface) ([]net.IP, int, error) {
+	intfIPs := make(map[string]bool)
+	for _, intf := range interfaces {
+		for _, ip := range intf.IPv4s {
+			intfIPs[ip.String()] = true
+		}
+	}
+
+	namespaces := nl.HostNamespaces()
+	found := []net.IP{}
+	for _, nsIP := range nl.GetNamespaceIPs(namespaces) {
+		if intfIPs[nsIP.IP.String()] {
+			found = append(found, nsIP.IP)
+		}
+	}
+	return found, len(namespaces), nil
+}
+
+// ReconcileInUseIPs reconciles the in-use IPs with a scan of the network
+// namespaces on the host now
+func ReconcileInUseIPs() error {
+	interfaces, err := DefaultClient.GetInterfaces()
+	if err != nil {
+		return err
+	}
+	_, err = (&lib.InUseIPs{}).Reconciled(0, reconcileGrace, func() ([]net.IP, int, error) {
+		return scanInterfaceIPs(interfaces)
+	})
+	return err
+}
+
+// ReconcileAfterBoot reconciles the registry and the in-use IPs with the
+// ENIs and the network namespaces on the host, once after each boot. This
+// keeps release times and quarantines across reboots while dropping the
+// IPs of Pods which did not survive them. Route tables allocated before
+// the boot whose policy routing rules are gone are released.
+func ReconcileAfterBoot() error {
+	return lib.OncePerBoot("", func() error {
+		interfaces, err := DefaultClient.GetInterfaces()
+		if err != nil {
+			return err
+		}
+		inUse, err := (&lib.InUseIPs{}).Reconciled(0, 0, func() ([]net.IP, int, error) {
+			return scanInterfaceIPs(interfaces)
+		})
+		if err != nil {
+			return err
+		}
+		if err := (&Registry{}).reconcileBoot(interfaces, inUse); err != nil {
+			return err
+		}
+		return releaseBootRouteTables()
+	})
+}
+
+// releaseBootRouteTables releases the route tables allocated before the
+// boot which no policy routing rule uses anymore
+func releaseBootRouteTables() error {
+	boot, err := lib.BootTime()
+	if err != nil {
+		return err
+	}
+	tables, err := nl.RouteTablesInUse()
+	if err != nil {
+		return err
+	}
+	_, err = (&lib.RouteTables{}).ReleaseUnused(tables, boot)
+	return err
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
 	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
 
@@ -165,8 +166,18 @@ func configureInterface(intf *Interface, mainIf string) {
 	}
 }
 
-// NewInterface creates an Interface based on specified parameters
-func (c *interfaceClient) NewInterface(secGrps []string, requiredTags map[string]string, ipBatchSize int64) (*Interface, error) {
+// NewInterface creates an Interface based on specified parameters.
+// Interfaces are created one at a time, as they take the next device
+// index.
+func (c *interfaceClient) NewInterface(secGrps []string, requiredTags map[string]string, ipBatchSize int64) (newIntf *Interface, err error) {
+	err = lib.WithLockTimeout(lib.LockInterfaceAttach, func() error {
+		newIntf, err = c.newInterface(secGrps, requiredTags, ipBatchSize)
+		return err
+	})
+	return
+}
+
+func (c *interfaceClient) newInterface(secGrps []string, requiredTags map[string]string, ipBatchSize int64) (*Interface, error) {
 	subnets, err := c.subnet.GetSubnetsForInstance()
 	if err != nil {
 		return nil, err
@@ -215,6 +226,12 @@ OUTER:
 // Simply detach the interface, wait for it to come down and then
 // removes.
 func (c *awsclient) RemoveInterface(interfaceIDs []string) error {
+	return lib.WithLockTimeout(lib.LockInterfaceAttach, func() error {
+		return c.removeInterface(interfaceIDs)
+	})
+}
+
+func (c *awsclient) removeInterface(interfaceIDs []string) error {
 	client, err := c.newEC2()
 	if err != nil {
 		return err
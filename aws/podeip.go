@@ -0,0 +1,95 @@
+package aws
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// AssociatePodElasticIP associates a free Elastic IP from the pool
+// identified by poolTags with the Pod IP of an allocation. When the pool
+// is exhausted and allocate is set, a new Elastic IP is allocated into
+// the pool.
+func AssociatePodElasticIP(alloc *AllocationResult, poolTags map[string]string, allocate bool) (*ElasticIP, error) {
+	if len(poolTags) == 0 {
+		return nil, fmt.Errorf("no Elastic IP pool tags configured")
+	}
+
+	// Reuse an Elastic IP already associated with this IP, e.g. on a
+	// retried ADD
+	existing, err := DefaultClient.DescribeAddressesOn(alloc.Interface.ID, *alloc.IP)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return existing[0], nil
+	}
+
+	pool, err := DefaultClient.DescribeAddressesByTags(poolTags)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, eip := range pool {
+		if eip.AssociationID != "" {
+			continue
+		}
+		// Another node may win the race for the same address, which
+		// fails the association as reassociation is not allowed
+		eip.AssociationID, err = DefaultClient.AssociateAddress(eip.AllocationID, alloc.Interface.ID, *alloc.IP)
+		if err == nil {
+			eip.NetworkInterfaceID = alloc.Interface.ID
+			eip.PrivateIP = *alloc.IP
+			return eip, nil
+		}
+	}
+
+	if !allocate {
+		return nil, fmt.Errorf("no free Elastic IP in the pool")
+	}
+
+	eip, err := DefaultClient.AllocateAddress(poolTags)
+	if err != nil {
+		return nil, err
+	}
+	eip.AssociationID, err = DefaultClient.AssociateAddress(eip.AllocationID, alloc.Interface.ID, *alloc.IP)
+	if err != nil {
+		return nil, err
+	}
+	eip.NetworkInterfaceID = alloc.Interface.ID
+	eip.PrivateIP = *alloc.IP
+	return eip, nil
+}
+
+// ReleasePodElasticIP disassociates any Elastic IP from a Pod IP,
+// returning it to its pool. It is called whether or not the Pod asked
+// for one, so a released IP never exposes its next Pod. Nodes not
+// permitted to describe Elastic IPs can't have associated any.
+func ReleasePodElasticIP(ip net.IP) error {
+	interfaces, err := DefaultClient.GetInterfaces()
+	if err != nil {
+		return err
+	}
+
+	for _, intf := range interfaces {
+		for _, addr := range intf.IPv4s {
+			if !addr.Equal(ip) {
+				continue
+			}
+			eips, err := DefaultClient.DescribeAddressesOn(intf.ID, ip)
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "UnauthorizedOperation" {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			for _, eip := range eips {
+				if err := DefaultClient.DisassociateAddress(eip.AssociationID); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
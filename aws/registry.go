@@ -1,13 +1,16 @@
 package aws
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
 	"path"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,11 +18,76 @@ import (
 )
 
 const (
-	registryDir           = "cni-ipvlan-vpc-k8s"
 	registryFile          = "registry.json"
-	registrySchemaVersion = 1
+	registrySchemaVersion = 3
+
+	// allocatingTimeout is how long an IP stays allocating without
+	// being found in use before its ADD is considered failed
+	allocatingTimeout = 5 * time.Minute
+)
+
+// IPState is the lifecycle state of an IP in the registry
+type IPState string
+
+// IPs are allocating while an ADD hands them out, in use once found in
+// a Pod, and free once released by DEL or found unused. Quarantined IPs
+// were found in use while the registry considered them free, and are not
+// handed out again until released anew. Deallocating IPs are being
+// unassigned from their ENI.
+const (
+	IPStateAllocating   IPState = "allocating"
+	IPStateInUse        IPState = "in-use"
+	IPStateFree         IPState = "free"
+	IPStateQuarantined  IPState = "quarantined"
+	IPStateDeallocating IPState = "deallocating"
 )
 
+// IPStates are all IP states
+var IPStates = []IPState{
+	IPStateAllocating,
+	IPStateInUse,
+	IPStateFree,
+	IPStateQuarantined,
+	IPStateDeallocating,
+}
+
+// deallocationTimeout is how long an IP stays claimed for deallocation
+// before another process may claim it again, as its claimant died
+const deallocationTimeout = 5 * time.Minute
+
+// registryMigrations upgrade the decoded JSON of a registry from the
+// schema version they are indexed by to the next one. Migrations must
+// keep working on the old format as written, so they do not use the
+// current registry types.
+var registryMigrations = map[int]func(contents map[string]interface{}) error{
+	1: migrateRegistryV1,
+	2: migrateRegistryV2,
+}
+
+// migrateRegistryV1 replaces the quarantined flag of v1 by a state
+func migrateRegistryV1(contents map[string]interface{}) error {
+	ips, _ := contents["ips"].(map[string]interface{})
+	for ipString, entry := range ips {
+		ip, ok := entry.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid entry for %v", ipString)
+		}
+		state := "free"
+		if quarantined, _ := ip["quarantined"].(bool); quarantined {
+			state = "quarantined"
+		}
+		delete(ip, "quarantined")
+		ip["state"] = state
+	}
+	return nil
+}
+
+// migrateRegistryV2 keeps all entries, as v3 only adds the states of IPs
+// which are not free and optional location, owner and time fields
+func migrateRegistryV2(contents map[string]interface{}) error {
+	return nil
+}
+
 func defaultRegistry() registryContents {
 	return registryContents{
 		SchemaVersion: registrySchemaVersion,
@@ -27,8 +95,42 @@ func defaultRegistry() registryContents {
 	}
 }
 
+// IPOwner is the Pod an IP is handed out to
+type IPOwner struct {
+	ContainerID string `json:"container_id,omitempty"`
+	// Pod is the namespace/name of the Pod, if known
+	Pod string `json:"pod,omitempty"`
+}
+
 type registryIP struct {
+	State       IPState `json:"state"`
+	InterfaceID string  `json:"interface_id,omitempty"`
+	Device      int     `json:"device"`
+	IPOwner
+	AssignedOn lib.JSONTime `json:"assigned_on"`
 	ReleasedOn lib.JSONTime `json:"released_on"`
+	LastSeen   lib.JSONTime `json:"last_seen"`
+	// DeallocatingOn is when the IP was claimed for deallocation
+	DeallocatingOn lib.JSONTime `json:"deallocating_on,omitempty"`
+}
+
+// RegistryEntry is an IP of the registry, with its state, ENI and owner
+type RegistryEntry struct {
+	IP          net.IP
+	State       IPState
+	InterfaceID string
+	Device      int
+	Owner       IPOwner
+	AssignedOn  time.Time
+	ReleasedOn  time.Time
+	LastSeen    time.Time
+}
+
+// ObservedIP is an IP of an ENI, found either in use or unused
+type ObservedIP struct {
+	IP        net.IP
+	Interface Interface
+	InUse     bool
 }
 
 type registryContents struct {
@@ -36,6 +138,24 @@ type registryContents struct {
 	IPs           map[string]*registryIP `json:"ips"`
 }
 
+// entry returns the entry of ip, adding it if it is not tracked yet
+func (rc *registryContents) entry(ip net.IP) *registryIP {
+	entry, ok := rc.IPs[ip.String()]
+	if !ok {
+		entry = &registryIP{}
+		rc.IPs[ip.String()] = entry
+	}
+	return entry
+}
+
+// locate records the ENI an IP is on
+func (entry *registryIP) locate(intf Interface) {
+	if intf.ID != "" {
+		entry.InterfaceID = intf.ID
+		entry.Device = intf.Number
+	}
+}
+
 // Registry defines a re-usable IP registry which tracks IPs that are
 // free in the system and when they were last released back to the pool.
 type Registry struct {
@@ -46,40 +166,98 @@ type Registry struct {
 // registryPath gives a default location for the registry
 // which varies based on invoking user ID
 func registryPath() string {
-	uid := os.Getuid()
-	if uid != 0 {
-		// Non-root users of the registry
-		return path.Join("/run/user", fmt.Sprintf("%d", uid), registryDir)
+	return lib.StatePath()
+}
+
+// acquire takes the registry lock, shared by all processes using the
+// registry, and returns a function releasing it
+func (r *Registry) acquire() (func(), error) {
+	r.lock.Lock()
+	rpath, err := r.ensurePath()
+	if err != nil {
+		r.lock.Unlock()
+		return nil, err
 	}
 
-	return path.Join("/run", registryDir)
+	ctx, cancel := context.WithTimeout(context.Background(), lib.LockTimeout)
+	defer cancel()
+	unlock, err := lib.Lock(ctx, path.Dir(rpath), lib.LockRegistry)
+	if err != nil {
+		r.lock.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		r.lock.Unlock()
+	}, nil
 }
 
 func (r *Registry) ensurePath() (string, error) {
 	if len(r.path) == 0 {
 		r.path = registryPath()
 	}
-	rpath := r.path
-	info, err := os.Stat(rpath)
-	if err != nil || !info.IsDir() {
-		err = os.MkdirAll(rpath, os.ModeDir|0700)
-		if err != nil {
-			return "", err
+	rpath, err := lib.EnsureStatePath(r.path)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(rpath, registryFile), nil
+}
+
+// decodeRegistry decodes a registry of the current or an older schema
+// version, migrating it to the current one. It returns the schema
+// version the registry was written with.
+func decodeRegistry(data []byte) (*registryContents, int, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, 0, err
+	}
+	version, ok := raw["schema_version"].(float64)
+	if !ok {
+		return nil, 0, fmt.Errorf("missing schema version")
+	}
+	from := int(version)
+	if from > registrySchemaVersion {
+		return nil, from, fmt.Errorf("schema version %v is newer than the supported %v", from, registrySchemaVersion)
+	}
+
+	for v := from; v < registrySchemaVersion; v++ {
+		migrate, ok := registryMigrations[v]
+		if !ok {
+			return nil, from, fmt.Errorf("no migration from schema version %v", v)
+		}
+		if err := migrate(raw); err != nil {
+			return nil, from, fmt.Errorf("migration from schema version %v failed: %v", v, err)
+		}
+	}
+	raw["schema_version"] = registrySchemaVersion
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, from, err
+	}
+	contents := defaultRegistry()
+	if err := json.Unmarshal(migrated, &contents); err != nil {
+		return nil, from, err
+	}
+	if contents.IPs == nil {
+		return nil, from, fmt.Errorf("missing ips")
+	}
+	for ipString, entry := range contents.IPs {
+		if entry == nil {
+			return nil, from, fmt.Errorf("missing entry for %v", ipString)
 		}
 	}
-	rpath = path.Join(rpath, registryFile)
-	return rpath, nil
+	return &contents, from, nil
 }
 
 func (r *Registry) load() (*registryContents, error) {
-	// Load the pre-versioned schema
 	contents := defaultRegistry()
 	rpath, err := r.ensurePath()
 	if err != nil {
 		return nil, err
 	}
 
-	file, err := os.Open(rpath)
+	data, err := ioutil.ReadFile(rpath)
 	if os.IsNotExist(err) {
 		// Return an empty registry, prefilled with IPs
 		// already existing on all interfaces and timestamped
@@ -87,9 +265,9 @@ func (r *Registry) load() (*registryContents, error) {
 		free, err := FindFreeIPsAtIndex(0, false)
 		if err == nil || len(free) > 0 {
 			for _, freeAlloc := range free {
-				contents.IPs[freeAlloc.IP.String()] = &registryIP{
-					ReleasedOn: lib.JSONTime{Time: time.Time{}},
-				}
+				entry := contents.entry(*freeAlloc.IP)
+				entry.State = IPStateFree
+				entry.locate(freeAlloc.Interface)
 			}
 			err = r.save(&contents)
 			return &contents, err
@@ -99,90 +277,419 @@ func (r *Registry) load() (*registryContents, error) {
 		return nil, err
 	}
 
-	defer file.Close()
+	decoded, _, err := decodeRegistry(data)
+	if err != nil {
+		// Resetting it would lose release times and quarantines, and
+		// hand out the IPs it tracks right away
+		return nil, fmt.Errorf("invalid registry %v, see registry-verify: %v", rpath, err)
+	}
+	return decoded, nil
+}
 
-	decoder := json.NewDecoder(file)
-	if decoder == nil {
-		return nil, fmt.Errorf("invalid decoder")
+func (r *Registry) save(rc *registryContents) error {
+	rpath, err := r.ensurePath()
+	if err != nil {
+		return err
+	}
+	rc.SchemaVersion = registrySchemaVersion
+	data, err := json.Marshal(rc)
+	if err != nil {
+		return err
 	}
+	return lib.WriteFileAtomic(rpath, append(data, '\n'), 0600)
+}
 
-	err = decoder.Decode(&contents)
+// Migrate rewrites the registry in the current schema version. It
+// returns the version the registry was written with, which is 0 if
+// there is no registry yet.
+func (r *Registry) Migrate() (int, error) {
+	unlock, err := r.acquire()
 	if err != nil {
-		log.Printf("invalid registry format, returning empty registry %v", err)
-		contents = defaultRegistry()
+		return 0, err
 	}
+	defer unlock()
 
-	// Reset the registry if the version is not what we can deal with.
-	// Add more states here, or just let the registry be blown away
-	// on invalid loads
-	if contents.SchemaVersion != registrySchemaVersion {
-		contents = defaultRegistry()
+	rpath, err := r.ensurePath()
+	if err != nil {
+		return 0, err
 	}
-	if contents.IPs == nil {
-		contents = defaultRegistry()
+	data, err := ioutil.ReadFile(rpath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	contents, from, err := decodeRegistry(data)
+	if err != nil {
+		return from, err
+	}
+	if from == registrySchemaVersion {
+		return from, nil
 	}
-	return &contents, nil
+	return from, r.save(contents)
 }
 
-func (r *Registry) save(rc *registryContents) error {
-	rpath, err := r.ensurePath()
+// Verify checks that the registry can be loaded without being reset,
+// returning its schema version and any problems found in it
+func (r *Registry) Verify() (int, []string, error) {
+	unlock, err := r.acquire()
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
-	file, err := os.OpenFile(rpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	defer unlock()
+
+	rpath, err := r.ensurePath()
 	if err != nil {
-		return err
+		return 0, nil, err
+	}
+	data, err := ioutil.ReadFile(rpath)
+	if os.IsNotExist(err) {
+		return 0, nil, nil
+	} else if err != nil {
+		return 0, nil, err
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	if encoder == nil {
-		return fmt.Errorf("could not make a new encoder")
+	contents, from, err := decodeRegistry(data)
+	if err != nil {
+		return from, []string{err.Error()}, nil
 	}
-	rc.SchemaVersion = registrySchemaVersion
-	err = encoder.Encode(rc)
-	return err
+	problems := []string{}
+	for ipString, entry := range contents.IPs {
+		if net.ParseIP(ipString) == nil {
+			problems = append(problems, fmt.Sprintf("invalid ip %q", ipString))
+		}
+		valid := false
+		for _, state := range IPStates {
+			valid = valid || entry.State == state
+		}
+		if !valid {
+			problems = append(problems, fmt.Sprintf("invalid state %q of %v", entry.State, ipString))
+		}
+	}
+	sort.Strings(problems)
+	return from, problems, nil
 }
 
 // TrackIPAtEpoch sets the IP recorded time as the epoch (0 time)
 // so it appears as immediately free and avoids re-allocation
 func (r *Registry) TrackIPAtEpoch(ip net.IP) error {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	unlock, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	contents, err := r.load()
 	if err != nil {
 		return err
 	}
 
-	contents.IPs[ip.String()] = &registryIP{
-		ReleasedOn: lib.JSONTime{Time: time.Time{}},
-	}
+	entry := contents.entry(ip)
+	entry.State = IPStateFree
+	entry.ReleasedOn = lib.JSONTime{Time: time.Time{}}
 	return r.save(contents)
 }
 
 // TrackIP records an IP in the free registry with the current system
 // time as the current freed-time. If an IP is freed again, the time
-// will be updated to the new current time.
+// will be updated to the new current time. Its ENI and last owner are
+// kept.
 func (r *Registry) TrackIP(ip net.IP) error {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	unlock, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	contents, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	entry := contents.entry(ip)
+	entry.State = IPStateFree
+	entry.ReleasedOn = lib.JSONTime{Time: time.Now()}
+	return r.save(contents)
+}
+
+// QuarantineIP records an IP as in use by an unknown owner, so it is
+// neither reused nor released until it is tracked as free again
+func (r *Registry) QuarantineIP(ip net.IP) error {
+	unlock, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	contents, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entry := contents.entry(ip)
+	entry.State = IPStateQuarantined
+	entry.ReleasedOn = lib.JSONTime{Time: now}
+	entry.LastSeen = lib.JSONTime{Time: now}
+	return r.save(contents)
+}
+
+// ClaimFreeIP marks an IP on intf allocating to owner if it is untracked,
+// or free and released before t. It returns whether the IP was claimed,
+// as other processes may claim it first.
+func (r *Registry) ClaimFreeIP(ip net.IP, t time.Time, intf Interface, owner IPOwner) (bool, error) {
+	unlock, err := r.acquire()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	contents, err := r.load()
+	if err != nil {
+		return false, err
+	}
+
+	entry, tracked := contents.IPs[ip.String()]
+	if tracked && (entry.State != IPStateFree || !entry.ReleasedOn.Before(t)) {
+		return false, nil
+	}
+	entry = contents.entry(ip)
+	entry.State = IPStateAllocating
+	entry.locate(intf)
+	entry.IPOwner = owner
+	entry.AssignedOn = lib.JSONTime{Time: time.Now()}
+	return true, r.save(contents)
+}
+
+// ClaimIPForDeallocation marks an IP deallocating if it is free and was
+// released before t, or was claimed for deallocation longer than
+// deallocationTimeout ago. It returns whether the IP was claimed, as
+// other processes may claim it first.
+func (r *Registry) ClaimIPForDeallocation(ip net.IP, t time.Time) (bool, error) {
+	unlock, err := r.acquire()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	contents, err := r.load()
+	if err != nil {
+		return false, err
+	}
+
+	entry, tracked := contents.IPs[ip.String()]
+	if !tracked {
+		return false, nil
+	}
+	now := time.Now()
+	switch {
+	case entry.State == IPStateFree && entry.ReleasedOn.Before(t):
+	case entry.State == IPStateDeallocating && entry.DeallocatingOn.Before(now.Add(-deallocationTimeout)):
+	default:
+		return false, nil
+	}
+	entry.State = IPStateDeallocating
+	entry.DeallocatingOn = lib.JSONTime{Time: now}
+	return true, r.save(contents)
+}
+
+// AbortDeallocation tracks an IP claimed for deallocation as free again,
+// unless another process deallocated and forgot it meanwhile
+func (r *Registry) AbortDeallocation(ip net.IP) error {
+	unlock, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	contents, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	entry, tracked := contents.IPs[ip.String()]
+	if !tracked || entry.State != IPStateDeallocating {
+		return nil
+	}
+	entry.State = IPStateFree
+	entry.ReleasedOn = lib.JSONTime{Time: time.Now()}
+	entry.DeallocatingOn = lib.JSONTime{}
+	return r.save(contents)
+}
+
+// MarkInUse records an IP on intf as in use by owner
+func (r *Registry) MarkInUse(ip net.IP, intf Interface, owner IPOwner) error {
+	unlock, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	contents, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entry := contents.entry(ip)
+	if entry.State != IPStateAllocating || entry.IPOwner != owner {
+		entry.AssignedOn = lib.JSONTime{Time: now}
+	}
+	entry.State = IPStateInUse
+	entry.locate(intf)
+	entry.IPOwner = owner
+	entry.LastSeen = lib.JSONTime{Time: now}
+	return r.save(contents)
+}
+
+// MarkDeallocating records an IP as being unassigned from its ENI. It is
+// forgotten once deallocated, or tracked as free again on failure with
+// AbortDeallocation.
+func (r *Registry) MarkDeallocating(ip net.IP) error {
+	unlock, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	contents, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	entry := contents.entry(ip)
+	entry.State = IPStateDeallocating
+	entry.DeallocatingOn = lib.JSONTime{Time: time.Now()}
+	return r.save(contents)
+}
+
+// ObserveIPs updates the states of IPs found in use or unused on the
+// host. IPs found in use are in use, except those being deallocated.
+// Unused IPs not tracked yet, or in use, are free from now on, as are
+// those allocating for longer than an ADD takes.
+func (r *Registry) ObserveIPs(observed []ObservedIP) error {
+	unlock, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	contents, err := r.load()
 	if err != nil {
 		return err
 	}
 
-	contents.IPs[ip.String()] = &registryIP{
-		ReleasedOn: lib.JSONTime{Time: time.Now()},
+	now := time.Now()
+	for _, o := range observed {
+		entry, tracked := contents.IPs[o.IP.String()]
+		if !tracked {
+			entry = contents.entry(o.IP)
+		}
+		entry.locate(o.Interface)
+
+		if o.InUse {
+			if entry.State != IPStateDeallocating {
+				entry.State = IPStateInUse
+			}
+			entry.LastSeen = lib.JSONTime{Time: now}
+			continue
+		}
+
+		stale := entry.State == IPStateAllocating && entry.AssignedOn.Before(now.Add(-allocatingTimeout))
+		if !tracked || entry.State == IPStateInUse || stale {
+			entry.State = IPStateFree
+			entry.ReleasedOn = lib.JSONTime{Time: now}
+		}
 	}
 	return r.save(contents)
 }
 
+// reconcileBoot updates the registry after the host rebooted. Pods do not
+// survive reboots, so IPs in use or allocating which are not found in use
+// again are released now. Free and quarantined IPs keep their state and
+// release time. IPs no longer assigned to one of interfaces are pruned.
+func (r *Registry) reconcileBoot(interfaces []Interface, inUse []net.IP) error {
+	unlock, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	contents, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	assigned := make(map[string]Interface)
+	for _, intf := range interfaces {
+		for _, ip := range intf.IPv4s {
+			assigned[ip.String()] = intf
+		}
+	}
+	found := make(map[string]bool)
+	for _, ip := range inUse {
+		found[ip.String()] = true
+	}
+
+	now := time.Now()
+	for ipString, entry := range contents.IPs {
+		intf, ok := assigned[ipString]
+		if !ok {
+			delete(contents.IPs, ipString)
+			continue
+		}
+		entry.locate(intf)
+		if found[ipString] {
+			entry.State = IPStateInUse
+			entry.LastSeen = lib.JSONTime{Time: now}
+		} else if entry.State == IPStateInUse || entry.State == IPStateAllocating {
+			entry.State = IPStateFree
+			entry.ReleasedOn = lib.JSONTime{Time: now}
+		}
+	}
+	return r.save(contents)
+}
+
+// QuarantinedIPs returns a list of all quarantined IPs
+func (r *Registry) QuarantinedIPs() ([]net.IP, error) {
+	return r.IPsInState(IPStateQuarantined)
+}
+
+// IPsInState returns a list of all IPs in state
+func (r *Registry) IPsInState(state IPState) ([]net.IP, error) {
+	unlock, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	contents, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+
+	returned := []net.IP{}
+	for ipString, entry := range contents.IPs {
+		if entry.State != state {
+			continue
+		}
+		ip := net.ParseIP(ipString)
+		if ip == nil {
+			continue
+		}
+		returned = append(returned, ip)
+	}
+	return returned, nil
+}
+
 // ForgetIP removes an IP from the registry
 func (r *Registry) ForgetIP(ip net.IP) error {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	unlock, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	contents, err := r.load()
 	if err != nil {
@@ -194,10 +701,13 @@ func (r *Registry) ForgetIP(ip net.IP) error {
 	return r.save(contents)
 }
 
-// HasIP checks if an IP is in an registry
+// HasIP checks if an IP is in an registry, in any state
 func (r *Registry) HasIP(ip net.IP) (bool, error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	unlock, err := r.acquire()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
 
 	contents, err := r.load()
 	if err != nil {
@@ -209,11 +719,14 @@ func (r *Registry) HasIP(ip net.IP) (bool, error) {
 }
 
 // TrackedBefore returns a list of all IPs last recorded time _before_
-// the time passed to this function. You probably want to call this
-// with time.Now().Add(-duration).
+// the time passed to this function, which are free. You probably want to
+// call this with time.Now().Add(-duration).
 func (r *Registry) TrackedBefore(t time.Time) ([]net.IP, error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	unlock, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
 	contents, err := r.load()
 	if err != nil {
@@ -222,7 +735,7 @@ func (r *Registry) TrackedBefore(t time.Time) ([]net.IP, error) {
 
 	returned := []net.IP{}
 	for ipString, entry := range contents.IPs {
-		if entry.ReleasedOn.Before(t) {
+		if entry.ReleasedOn.Before(t) && entry.State == IPStateFree {
 			ip := net.ParseIP(ipString)
 			if ip == nil {
 				continue
@@ -235,8 +748,11 @@ func (r *Registry) TrackedBefore(t time.Time) ([]net.IP, error) {
 
 // Clear clears the registry unconditionally
 func (r *Registry) Clear() error {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	unlock, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	rpath, err := r.ensurePath()
 	if err != nil {
@@ -253,8 +769,11 @@ func (r *Registry) Clear() error {
 
 // List returns a list of all tracked IPs
 func (r *Registry) List() (ret []net.IP, err error) {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	unlock, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
 	contents, err := r.load()
 	if err != nil {
@@ -266,6 +785,42 @@ func (r *Registry) List() (ret []net.IP, err error) {
 	return
 }
 
+// Entries returns all entries of the registry, sorted by IP
+func (r *Registry) Entries() ([]RegistryEntry, error) {
+	unlock, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	contents, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []RegistryEntry{}
+	for ipString, entry := range contents.IPs {
+		ip := net.ParseIP(ipString)
+		if ip == nil {
+			continue
+		}
+		entries = append(entries, RegistryEntry{
+			IP:          ip,
+			State:       entry.State,
+			InterfaceID: entry.InterfaceID,
+			Device:      entry.Device,
+			Owner:       entry.IPOwner,
+			AssignedOn:  entry.AssignedOn.Time,
+			ReleasedOn:  entry.ReleasedOn.Time,
+			LastSeen:    entry.LastSeen.Time,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].IP.To16(), entries[j].IP.To16()) < 0
+	})
+	return entries, nil
+}
+
 // Jitter takes a duration and adjusts it forward by a up to `pct` percent
 // uniformly.
 func Jitter(d time.Duration, pct float64) time.Duration {
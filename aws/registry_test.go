@@ -1,7 +1,10 @@
 package aws
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
+	"path"
 	"testing"
 	"time"
 )
@@ -119,3 +122,241 @@ func TestJitter(t *testing.T) {
 		t.Fatalf("Jitter moved more than 10pct forward %v", d1p)
 	}
 }
+
+func TestRegistry_QuarantineIP(t *testing.T) {
+	r := &Registry{}
+
+	err := r.Clear()
+	if err != nil {
+		t.Fatalf("clear failed %v", err)
+	}
+
+	_ = r.TrackIPAtEpoch(net.ParseIP(IP1))
+	if err = r.QuarantineIP(net.ParseIP(IP1)); err != nil {
+		t.Fatalf("Failed to quarantine IP %v", err)
+	}
+
+	ips, err := r.TrackedBefore(time.Now().Add(time.Hour))
+	if err != nil || len(ips) != 0 {
+		t.Fatalf("Quarantined IP returned as free %v %v", ips, err)
+	}
+	ips, err = r.QuarantinedIPs()
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP(IP1)) {
+		t.Fatalf("Quarantined IP not listed %v %v", ips, err)
+	}
+
+	// Releasing the IP again lifts the quarantine
+	_ = r.TrackIP(net.ParseIP(IP1))
+	ips, err = r.QuarantinedIPs()
+	if err != nil || len(ips) != 0 {
+		t.Fatalf("Quarantine not lifted %v %v", ips, err)
+	}
+}
+
+func TestRegistry_MigrateV1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	r := &Registry{path: dir}
+
+	v1 := `{"schema_version":1,"ips":{` +
+		`"127.0.0.1":{"released_on":"2018-01-01T00:00:00Z"},` +
+		`"127.0.0.2":{"released_on":"2018-01-01T00:00:00Z","quarantined":true}}}`
+	if err := ioutil.WriteFile(path.Join(dir, registryFile), []byte(v1), 0600); err != nil {
+		t.Fatalf("unable to write registry %v", err)
+	}
+
+	version, problems, err := r.Verify()
+	if err != nil || version != 1 || len(problems) != 0 {
+		t.Fatalf("unexpected verification of v1 %v %v %v", version, problems, err)
+	}
+
+	from, err := r.Migrate()
+	if err != nil || from != 1 {
+		t.Fatalf("migration failed %v %v", from, err)
+	}
+	if version, _, _ = r.Verify(); version != registrySchemaVersion {
+		t.Fatalf("registry not rewritten, still at version %v", version)
+	}
+
+	free, err := r.TrackedBefore(time.Now())
+	if err != nil || len(free) != 1 || !free[0].Equal(net.ParseIP(IP1)) {
+		t.Fatalf("free IP not migrated %v %v", free, err)
+	}
+	quarantined, err := r.QuarantinedIPs()
+	if err != nil || len(quarantined) != 1 || !quarantined[0].Equal(net.ParseIP(IP2)) {
+		t.Fatalf("quarantined IP not migrated %v %v", quarantined, err)
+	}
+}
+
+func TestRegistry_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	r := &Registry{path: dir}
+	rpath := path.Join(dir, registryFile)
+
+	// A registry from a newer version is not downgraded
+	if err := ioutil.WriteFile(rpath, []byte(`{"schema_version":99,"ips":{}}`), 0600); err != nil {
+		t.Fatalf("unable to write registry %v", err)
+	}
+	if _, problems, err := r.Verify(); err != nil || len(problems) != 1 {
+		t.Fatalf("expected a problem with a newer registry %v %v", problems, err)
+	}
+	if _, err := r.Migrate(); err == nil {
+		t.Fatalf("newer registry migrated")
+	}
+
+	// A truncated registry fails loudly rather than being overwritten
+	truncated := []byte(`{"schema_version":2,"ips":{"127.`)
+	if err := ioutil.WriteFile(rpath, truncated, 0600); err != nil {
+		t.Fatalf("unable to write registry %v", err)
+	}
+	if err := r.TrackIP(net.ParseIP(IP1)); err == nil {
+		t.Fatalf("tracked IP in an invalid registry")
+	}
+	if data, err := ioutil.ReadFile(rpath); err != nil || string(data) != string(truncated) {
+		t.Fatalf("invalid registry not kept %q %v", data, err)
+	}
+	if _, problems, err := r.Verify(); err != nil || len(problems) != 1 {
+		t.Fatalf("expected a problem with a truncated registry %v %v", problems, err)
+	}
+}
+
+func TestRegistry_States(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	r := &Registry{path: dir}
+	if err := r.TrackIP(net.ParseIP(IP3)); err != nil {
+		t.Fatalf("Failed to track IP %v", err)
+	}
+
+	intf := Interface{ID: "eni-1", Number: 2}
+	owner := IPOwner{ContainerID: "container-1", Pod: "default/pod-1"}
+	if claimed, err := r.ClaimFreeIP(net.ParseIP(IP1), time.Now(), intf, owner); !claimed || err != nil {
+		t.Fatalf("Failed to claim IP %v %v", claimed, err)
+	}
+	if claimed, err := r.ClaimFreeIP(net.ParseIP(IP1), time.Now(), intf, owner); claimed || err != nil {
+		t.Fatalf("Claimed IP twice %v %v", claimed, err)
+	}
+
+	// Allocating IPs are neither free nor freed when not found in use
+	_ = r.ObserveIPs([]ObservedIP{{IP: net.ParseIP(IP1), Interface: intf}})
+	if ips, _ := r.IPsInState(IPStateAllocating); len(ips) != 1 {
+		t.Fatalf("Allocating IP not listed %v", ips)
+	}
+	if ips, _ := r.TrackedBefore(time.Now().Add(time.Hour)); len(ips) != 1 || !ips[0].Equal(net.ParseIP(IP3)) {
+		t.Fatalf("Allocating IP returned as free %v", ips)
+	}
+
+	if err := r.MarkInUse(net.ParseIP(IP1), intf, owner); err != nil {
+		t.Fatalf("Failed to mark IP in use %v", err)
+	}
+	entries, err := r.Entries()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected 2 entries %v %v", entries, err)
+	}
+	entry := entries[0]
+	if !entry.IP.Equal(net.ParseIP(IP1)) || entry.State != IPStateInUse || entry.InterfaceID != "eni-1" ||
+		entry.Device != 2 || entry.Owner != owner || entry.AssignedOn.IsZero() || entry.LastSeen.IsZero() {
+		t.Fatalf("Unexpected in use entry %+v", entry)
+	}
+
+	// In use IPs found unused were released without a DEL
+	_ = r.ObserveIPs([]ObservedIP{
+		{IP: net.ParseIP(IP1), Interface: intf},
+		{IP: net.ParseIP(IP2), Interface: intf, InUse: true},
+	})
+	entries, _ = r.Entries()
+	if len(entries) != 3 || entries[0].State != IPStateFree || entries[0].ReleasedOn.IsZero() ||
+		entries[0].Owner != owner || entries[1].State != IPStateInUse {
+		t.Fatalf("Unexpected entries after observing %+v", entries)
+	}
+
+	if err := r.MarkDeallocating(net.ParseIP(IP3)); err != nil {
+		t.Fatalf("Failed to mark IP deallocating %v", err)
+	}
+	if ips, _ := r.IPsInState(IPStateDeallocating); len(ips) != 1 || !ips[0].Equal(net.ParseIP(IP3)) {
+		t.Fatalf("Deallocating IP not listed %v", ips)
+	}
+	if _, problems, _ := r.Verify(); len(problems) != 0 {
+		t.Fatalf("Unexpected problems %v", problems)
+	}
+}
+
+func TestRegistry_ClaimIPForDeallocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	r := &Registry{path: dir}
+	ip := net.ParseIP(IP1)
+
+	_ = r.TrackIP(ip)
+	if claimed, err := r.ClaimIPForDeallocation(ip, time.Now().Add(time.Minute)); !claimed || err != nil {
+		t.Fatalf("expected to claim a free IP, got %v %v", claimed, err)
+	}
+	// A recent claim, e.g. by a DEL, is not taken over
+	if claimed, err := r.ClaimIPForDeallocation(ip, time.Now().Add(time.Minute)); claimed || err != nil {
+		t.Fatalf("expected not to claim a deallocating IP, got %v %v", claimed, err)
+	}
+
+	// Aborting the deallocation of a forgotten IP does not track it again
+	_ = r.ForgetIP(ip)
+	if err := r.AbortDeallocation(ip); err != nil {
+		t.Fatalf("abort failed %v", err)
+	}
+	if tracked, _ := r.HasIP(ip); tracked {
+		t.Fatalf("expected a forgotten IP to stay forgotten")
+	}
+
+	_ = r.MarkDeallocating(ip)
+	if err := r.AbortDeallocation(ip); err != nil {
+		t.Fatalf("abort failed %v", err)
+	}
+	if ips, _ := r.IPsInState(IPStateFree); len(ips) != 1 || !ips[0].Equal(ip) {
+		t.Fatalf("expected the IP to be free again, got %v", ips)
+	}
+}
+
+func TestRegistry_ReconcileBoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	r := &Registry{path: dir}
+
+	intf := Interface{ID: "eni-1", Number: 1, IPv4s: []net.IP{net.ParseIP(IP1), net.ParseIP(IP2), net.ParseIP(IP3)}}
+	owner := IPOwner{ContainerID: "container-1"}
+	_ = r.TrackIPAtEpoch(net.ParseIP(IP1))
+	_ = r.MarkInUse(net.ParseIP(IP2), intf, owner)
+	_ = r.QuarantineIP(net.ParseIP(IP3))
+	_ = r.TrackIP(net.ParseIP("127.0.0.4"))
+
+	if err := r.reconcileBoot([]Interface{intf}, nil); err != nil {
+		t.Fatalf("reconciliation failed %v", err)
+	}
+
+	entries, err := r.Entries()
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("expected the IP not on an ENI pruned %v %v", entries, err)
+	}
+	if entries[0].State != IPStateFree || !entries[0].ReleasedOn.IsZero() || entries[0].InterfaceID != "eni-1" {
+		t.Errorf("free IP not kept %+v", entries[0])
+	}
+	if entries[1].State != IPStateFree || entries[1].ReleasedOn.IsZero() {
+		t.Errorf("IP of a Pod lost in the reboot not released %+v", entries[1])
+	}
+	if entries[2].State != IPStateQuarantined {
+		t.Errorf("quarantine not kept %+v", entries[2])
+	}
+}
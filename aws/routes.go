@@ -0,0 +1,118 @@
+package aws
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
+)
+
+// RouteConf selects the CIDRs routed from Pods over their interface
+// rather than through the host masquerade
+type RouteConf struct {
+	RouteToVPCPeers bool              `json:"routeToVpcPeers"`
+	VPCPeerTags     map[string]string `json:"vpcPeerTags"`
+	ExcludeOverlap  bool              `json:"excludeOverlappingPeers"`
+	RouteToTGWs     bool              `json:"routeToTransitGateways"`
+	RouteToCidrs    []string          `json:"routeToCidrs"`
+	RouteToPLs      []string          `json:"routeToPrefixLists"`
+	// MaxRoutes caps the number of routes after aggregation, 0 means
+	// no limit
+	MaxRoutes int `json:"maxRoutes"`
+}
+
+// PodRouteCIDRs returns the aggregated CIDRs routed over an interface:
+// the VPC CIDRs and those selected by conf. CIDRs are only merged with
+// others reached through the same path, so the ipvlan plugin still finds
+// the MTU of each route. Over conf.MaxRoutes, the routes of the last
+// paths are dropped with a warning: their traffic goes through the host.
+func PodRouteCIDRs(intf Interface, conf *RouteConf) ([]*net.IPNet, error) {
+	var err error
+	vpcCidrs := intf.VpcCidrs
+	if HasBugBrokenVPCCidrs(DefaultClient) {
+		vpcCidrs, err = DefaultClient.DescribeVPCCIDRs(intf.VpcID)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to enumerate CIDRs from the AWS API due to a specific meta-data bug %v", err)
+		}
+	}
+
+	var peerCidrs, interRegionPeerCidrs []*net.IPNet
+	if conf.RouteToVPCPeers {
+		peerCidr, err := DefaultClient.DescribeVPCPeerCIDRs(intf.VpcID, conf.VPCPeerTags)
+		if err != nil {
+			return nil, fmt.Errorf("unable to enumerate peer CIDrs %v", err)
+		}
+		if conf.ExcludeOverlap {
+			var excluded []*net.IPNet
+			peerCidr, excluded = ExcludeOverlappingCIDRs(peerCidr, vpcCidrs)
+			for _, cidr := range excluded {
+				fmt.Fprintf(os.Stderr, "Warning: not routing to peer CIDR %v overlapping the VPC\n", cidr)
+			}
+		}
+		interRegion, err := DefaultClient.DescribeVPCInterRegionPeerCIDRs(intf.VpcID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to enumerate inter-region peer CIDRs %v", err)
+		}
+		remote := make(map[string]bool)
+		for _, cidr := range interRegion {
+			remote[cidr.String()] = true
+		}
+		for _, cidr := range peerCidr {
+			if remote[cidr.String()] {
+				interRegionPeerCidrs = append(interRegionPeerCidrs, cidr)
+			} else {
+				peerCidrs = append(peerCidrs, cidr)
+			}
+		}
+	}
+
+	var tgwCidrs []*net.IPNet
+	if conf.RouteToTGWs {
+		tgwCidrs, err = DefaultClient.DescribeVPCTransitGatewayCIDRs(intf.VpcID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to enumerate transit gateway CIDRs %v", err)
+		}
+	}
+
+	var externalCidrs []*net.IPNet
+	for _, prefixList := range conf.RouteToPLs {
+		plCidrs, err := DefaultClient.DescribePrefixListCIDRs(prefixList)
+		if err != nil {
+			return nil, fmt.Errorf("unable to enumerate prefix list %v CIDRs %v", prefixList, err)
+		}
+		// Pod routes are IPv4 only, ignore entries of IPv6 prefix lists
+		for _, cidr := range plCidrs {
+			if cidr.IP.To4() != nil {
+				externalCidrs = append(externalCidrs, cidr)
+			}
+		}
+	}
+
+	for _, cidr := range conf.RouteToCidrs {
+		_, parsed, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse routeToCidrs element %v", err)
+		}
+		externalCidrs = append(externalCidrs, parsed)
+	}
+
+	// Each route is also copied into the per-Pod table of the
+	// unnumbered-ptp plugin, keep as few as possible. Routes within the
+	// VPC are always kept.
+	maxRoutes := conf.MaxRoutes
+	if vpcRoutes := len(lib.AggregateCIDRs(vpcCidrs)); maxRoutes > 0 && maxRoutes < vpcRoutes {
+		maxRoutes = vpcRoutes
+	}
+	cidrs, dropped := lib.AggregateRoutes([][]*net.IPNet{
+		vpcCidrs,
+		peerCidrs,
+		interRegionPeerCidrs,
+		tgwCidrs,
+		externalCidrs,
+	}, maxRoutes)
+	if len(dropped) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: not routing to %v over maxRoutes %d\n", dropped, maxRoutes)
+	}
+	return cidrs, nil
+}
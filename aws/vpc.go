@@ -3,18 +3,25 @@ package aws
 import (
 	"fmt"
 	"net"
+	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 
 	"github.com/lyft/cni-ipvlan-vpc-k8s/aws/cache"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
 )
 
 // VPCClient provides a view into a VPC
 type VPCClient interface {
 	DescribeVPCCIDRs(vpcID string) ([]*net.IPNet, error)
-	DescribeVPCPeerCIDRs(vpcID string) ([]*net.IPNet, error)
+	DescribeVPCPeerCIDRs(vpcID string, peerTags map[string]string) ([]*net.IPNet, error)
+	DescribeVPCInterRegionPeerCIDRs(vpcID string) ([]*net.IPNet, error)
+	DescribeVPCTransitGatewayCIDRs(vpcID string) ([]*net.IPNet, error)
+	DescribePrefixListCIDRs(prefixListID string) ([]*net.IPNet, error)
 }
 
 type vpcCacheClient struct {
@@ -36,19 +43,69 @@ func (v *vpcCacheClient) DescribeVPCCIDRs(vpcID string) (cidrs []*net.IPNet, err
 	return
 }
 
-func (v *vpcCacheClient) DescribeVPCPeerCIDRs(vpcID string) (cidrs []*net.IPNet, err error) {
+func (v *vpcCacheClient) DescribeVPCPeerCIDRs(vpcID string, peerTags map[string]string) (cidrs []*net.IPNet, err error) {
 	key := fmt.Sprintf("vpc-peers-%v", vpcID)
+	if len(peerTags) > 0 {
+		var tags []string
+		for k, v := range peerTags {
+			tags = append(tags, fmt.Sprintf("%s=%s", k, v))
+		}
+		sort.Strings(tags)
+		key = fmt.Sprintf("%v-%v", key, strings.Join(tags, ","))
+	}
+	state := cache.Get(key, &cidrs)
+	if state == cache.CacheFound {
+		return
+	}
+	cidrs, err = v.vpc.DescribeVPCPeerCIDRs(vpcID, peerTags)
+	if err != nil {
+		return nil, err
+	}
+	cache.Store(key, v.expiration, &cidrs)
+	return
+
+}
+
+func (v *vpcCacheClient) DescribeVPCInterRegionPeerCIDRs(vpcID string) (cidrs []*net.IPNet, err error) {
+	key := fmt.Sprintf("vpc-inter-region-peers-%v", vpcID)
 	state := cache.Get(key, &cidrs)
 	if state == cache.CacheFound {
 		return
 	}
-	cidrs, err = v.vpc.DescribeVPCPeerCIDRs(vpcID)
+	cidrs, err = v.vpc.DescribeVPCInterRegionPeerCIDRs(vpcID)
 	if err != nil {
 		return nil, err
 	}
 	cache.Store(key, v.expiration, &cidrs)
 	return
+}
 
+func (v *vpcCacheClient) DescribeVPCTransitGatewayCIDRs(vpcID string) (cidrs []*net.IPNet, err error) {
+	key := fmt.Sprintf("vpc-tgws-%v", vpcID)
+	state := cache.Get(key, &cidrs)
+	if state == cache.CacheFound {
+		return
+	}
+	cidrs, err = v.vpc.DescribeVPCTransitGatewayCIDRs(vpcID)
+	if err != nil {
+		return nil, err
+	}
+	cache.Store(key, v.expiration, &cidrs)
+	return
+}
+
+func (v *vpcCacheClient) DescribePrefixListCIDRs(prefixListID string) (cidrs []*net.IPNet, err error) {
+	key := fmt.Sprintf("prefix-list-%v", prefixListID)
+	state := cache.Get(key, &cidrs)
+	if state == cache.CacheFound {
+		return
+	}
+	cidrs, err = v.vpc.DescribePrefixListCIDRs(prefixListID)
+	if err != nil {
+		return nil, err
+	}
+	cache.Store(key, v.expiration, &cidrs)
+	return
 }
 
 type vpcclient struct {
@@ -87,16 +144,29 @@ func (v *vpcclient) DescribeVPCCIDRs(vpcID string) ([]*net.IPNet, error) {
 	return cidrs, nil
 }
 
-// DescribeVPCPeerCIDRs returns a list of CIDRs for all peered VPCs to the given VPC
-func (v *vpcclient) DescribeVPCPeerCIDRs(vpcID string) ([]*net.IPNet, error) {
-	ec2c, err := v.aws.newEC2()
+// DescribeVPCPeerCIDRs returns a list of CIDRs for all active peerings
+// of the given VPC whose peering connection carries all of peerTags
+func (v *vpcclient) DescribeVPCPeerCIDRs(vpcID string, peerTags map[string]string) ([]*net.IPNet, error) {
+	return v.describeVPCPeerCIDRs(vpcID, peerTags, func(*ec2.VpcPeeringConnectionVpcInfo) bool { return true })
+}
+
+// DescribeVPCInterRegionPeerCIDRs returns a list of CIDRs for all active
+// peerings of the given VPC with VPCs in other regions
+func (v *vpcclient) DescribeVPCInterRegionPeerCIDRs(vpcID string) ([]*net.IPNet, error) {
+	id, err := v.aws.getIDDoc()
 	if err != nil {
 		return nil, err
 	}
+	return v.describeVPCPeerCIDRs(vpcID, nil, func(peer *ec2.VpcPeeringConnectionVpcInfo) bool {
+		region := aws.StringValue(peer.Region)
+		return region != "" && region != id.Region
+	})
+}
 
-	req := &ec2.DescribeVpcPeeringConnectionsInput{}
-
-	res, err := ec2c.DescribeVpcPeeringConnections(req)
+// describeVPCPeerCIDRs returns the CIDRs of the peers accepted by include
+// of all active peerings of the given VPC carrying all of peerTags
+func (v *vpcclient) describeVPCPeerCIDRs(vpcID string, peerTags map[string]string, include func(peer *ec2.VpcPeeringConnectionVpcInfo) bool) ([]*net.IPNet, error) {
+	ec2c, err := v.aws.newEC2()
 	if err != nil {
 		return nil, err
 	}
@@ -107,22 +177,50 @@ func (v *vpcclient) DescribeVPCPeerCIDRs(vpcID string) ([]*net.IPNet, error) {
 	// to de-duplicate them.
 	cidrs := make(map[string]bool)
 
-	for _, peering := range res.VpcPeeringConnections {
-		var peer *ec2.VpcPeeringConnectionVpcInfo
-
-		if vpcID == *peering.AccepterVpcInfo.VpcId {
-			peer = peering.RequesterVpcInfo
-		} else if vpcID == *peering.RequesterVpcInfo.VpcId {
-			peer = peering.AccepterVpcInfo
-		} else {
-			continue
+	// Filters are ANDed, so the peerings where the VPC is the
+	// accepter and those where it is the requester are listed
+	// separately
+	for _, side := range []string{"accepter-vpc-info.vpc-id", "requester-vpc-info.vpc-id"} {
+		req := &ec2.DescribeVpcPeeringConnectionsInput{
+			Filters: []*ec2.Filter{
+				newEc2Filter(side, vpcID),
+				newEc2Filter("status-code", ec2.VpcPeeringConnectionStateReasonCodeActive),
+			},
+		}
+		for k, v := range peerTags {
+			req.Filters = append(req.Filters, newEc2Filter(fmt.Sprintf("tag:%s", k), v))
 		}
 
-		for _, cidrBlock := range peer.CidrBlockSet {
-			_, _, err := net.ParseCIDR(*cidrBlock.CidrBlock)
-			if err == nil {
-				cidrs[*cidrBlock.CidrBlock] = true
+		for {
+			res, err := ec2c.DescribeVpcPeeringConnections(req)
+			if err != nil {
+				return nil, err
 			}
+
+			for _, peering := range res.VpcPeeringConnections {
+				var peer *ec2.VpcPeeringConnectionVpcInfo
+
+				if peering.AccepterVpcInfo != nil && vpcID == aws.StringValue(peering.AccepterVpcInfo.VpcId) {
+					peer = peering.RequesterVpcInfo
+				} else if peering.RequesterVpcInfo != nil && vpcID == aws.StringValue(peering.RequesterVpcInfo.VpcId) {
+					peer = peering.AccepterVpcInfo
+				}
+				if peer == nil || !include(peer) {
+					continue
+				}
+
+				for _, cidrBlock := range peer.CidrBlockSet {
+					_, _, err := net.ParseCIDR(aws.StringValue(cidrBlock.CidrBlock))
+					if err == nil {
+						cidrs[*cidrBlock.CidrBlock] = true
+					}
+				}
+			}
+
+			if res.NextToken == nil {
+				break
+			}
+			req.NextToken = res.NextToken
 		}
 	}
 
@@ -135,3 +233,172 @@ func (v *vpcclient) DescribeVPCPeerCIDRs(vpcID string) ([]*net.IPNet, error) {
 	}
 	return returnCidrs, nil
 }
+
+// ExcludeOverlappingCIDRs splits cidrs into those which don't overlap
+// any of the local CIDRs and those which do
+func ExcludeOverlappingCIDRs(cidrs []*net.IPNet, local []*net.IPNet) (kept []*net.IPNet, excluded []*net.IPNet) {
+	for _, cidr := range cidrs {
+		overlaps := false
+		for _, l := range local {
+			if cidr.Contains(l.IP) || l.Contains(cidr.IP) {
+				overlaps = true
+				break
+			}
+		}
+		if overlaps {
+			excluded = append(excluded, cidr)
+		} else {
+			kept = append(kept, cidr)
+		}
+	}
+	return
+}
+
+// DescribeVPCTransitGatewayCIDRs returns a list of CIDRs the route tables
+// of the given VPC send to a transit gateway, including the entries of
+// prefix lists routed there, but not a default route
+func (v *vpcclient) DescribeVPCTransitGatewayCIDRs(vpcID string) ([]*net.IPNet, error) {
+	ec2c, err := v.aws.newEC2()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{
+			newEc2Filter("vpc-id", vpcID),
+		},
+	}
+
+	// Several route tables usually route the same CIDRs to a transit
+	// gateway, de-duplicate them
+	cidrs := make(map[string]bool)
+	prefixLists := make(map[string]bool)
+	for {
+		res, err := ec2c.DescribeRouteTables(req)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range res.RouteTables {
+			for _, route := range table.Routes {
+				// Skip routes to detached transit gateways
+				if route.TransitGatewayId == nil || aws.StringValue(route.State) != ec2.RouteStateActive {
+					continue
+				}
+				if route.DestinationCidrBlock != nil {
+					cidrs[*route.DestinationCidrBlock] = true
+				} else if route.DestinationPrefixListId != nil {
+					prefixLists[*route.DestinationPrefixListId] = true
+				}
+			}
+		}
+		if res.NextToken == nil {
+			break
+		}
+		req.NextToken = res.NextToken
+	}
+
+	// Routes may also go to the entries of a prefix list
+	for prefixList := range prefixLists {
+		plCidrs, err := v.DescribePrefixListCIDRs(prefixList)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: not routing to transit gateway prefix list %v: %v\n", prefixList, err)
+			continue
+		}
+		for _, cidr := range plCidrs {
+			cidrs[cidr.String()] = true
+		}
+	}
+
+	var returnCidrs []*net.IPNet
+	for cidrString := range cidrs {
+		_, cidr, err := net.ParseCIDR(cidrString)
+		if err != nil || cidr == nil || cidr.IP.To4() == nil {
+			continue
+		}
+		// Centralized egress VPCs send their default route to a transit
+		// gateway. Pods keep theirs through the host.
+		if ones, _ := cidr.Mask.Size(); ones == 0 {
+			continue
+		}
+		returnCidrs = append(returnCidrs, cidr)
+	}
+	return returnCidrs, nil
+}
+
+// DescribePrefixListCIDRs returns the CIDRs of the entries of a managed
+// prefix list
+func (v *vpcclient) DescribePrefixListCIDRs(prefixListID string) ([]*net.IPNet, error) {
+	ec2c, err := v.aws.newEC2()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &ec2.GetManagedPrefixListEntriesInput{
+		PrefixListId: aws.String(prefixListID),
+	}
+
+	var cidrs []*net.IPNet
+	for {
+		res, err := ec2c.GetManagedPrefixListEntries(req)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range res.Entries {
+			_, cidr, err := net.ParseCIDR(aws.StringValue(entry.Cidr))
+			if err == nil && cidr != nil {
+				cidrs = append(cidrs, cidr)
+			}
+		}
+		if res.NextToken == nil {
+			break
+		}
+		req.NextToken = res.NextToken
+	}
+	return cidrs, nil
+}
+
+// InterfaceRoutePaths classifies the destinations of routes over a local
+// interface by the path their traffic takes, to select their MTU. Peers
+// and transit gateways are only looked up if mtus tells them apart from
+// external routes, and are left out with a warning if they can't be.
+func InterfaceRoutePaths(ifName string, mtus *lib.RouteMTUs) (*lib.RoutePaths, error) {
+	interfaces, err := DefaultClient.GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, intf := range interfaces {
+		if intf.LocalName() != ifName {
+			continue
+		}
+
+		paths := &lib.RoutePaths{VPC: intf.VpcCidrs}
+		if HasBugBrokenVPCCidrs(DefaultClient) {
+			paths.VPC, err = DefaultClient.DescribeVPCCIDRs(intf.VpcID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if mtus.NeedsPeers() {
+			if paths.Peer, err = DefaultClient.DescribeVPCPeerCIDRs(intf.VpcID, nil); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: unable to enumerate peer CIDRs of %v: %v\n", intf.VpcID, err)
+			}
+			if paths.InterRegionPeer, err = DefaultClient.DescribeVPCInterRegionPeerCIDRs(intf.VpcID); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: unable to enumerate inter-region peer CIDRs of %v: %v\n", intf.VpcID, err)
+			}
+		}
+		if mtus.NeedsTransitGateways() {
+			if paths.TransitGateway, err = DefaultClient.DescribeVPCTransitGatewayCIDRs(intf.VpcID); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: unable to enumerate transit gateway CIDRs of %v: %v\n", intf.VpcID, err)
+			}
+		}
+
+		// Pod routes are aggregated within each path, aggregate the
+		// paths alike so they contain the merged routes
+		paths.VPC = lib.AggregateCIDRs(paths.VPC)
+		paths.Peer = lib.AggregateCIDRs(paths.Peer)
+		paths.InterRegionPeer = lib.AggregateCIDRs(paths.InterRegionPeer)
+		paths.TransitGateway = lib.AggregateCIDRs(paths.TransitGateway)
+		return paths, nil
+	}
+	return nil, fmt.Errorf("interface %v not found", ifName)
+}
@@ -0,0 +1,239 @@
+package aws
+
+import (
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+type ec2RouteTablesMock struct {
+	ec2iface.EC2API
+	Pages       []ec2.DescribeRouteTablesOutput
+	PrefixLists map[string][]*ec2.PrefixListEntry
+}
+
+func (e *ec2RouteTablesMock) GetManagedPrefixListEntries(in *ec2.GetManagedPrefixListEntriesInput) (*ec2.GetManagedPrefixListEntriesOutput, error) {
+	return &ec2.GetManagedPrefixListEntriesOutput{Entries: e.PrefixLists[aws.StringValue(in.PrefixListId)]}, nil
+}
+
+func (e *ec2RouteTablesMock) DescribeRouteTables(in *ec2.DescribeRouteTablesInput) (*ec2.DescribeRouteTablesOutput, error) {
+	page := 0
+	if in.NextToken != nil {
+		page = 1
+	}
+	return &e.Pages[page], nil
+}
+
+func newTestVpcClient(ec2Client ec2iface.EC2API) *vpcclient {
+	return &vpcclient{
+		aws: &awsclient{
+			idDoc:     &ec2metadata.EC2InstanceIdentityDocument{Region: "us-east-1"},
+			ec2Client: ec2Client,
+		},
+	}
+}
+
+func TestDescribeVPCTransitGatewayCIDRs(t *testing.T) {
+	mock := &ec2RouteTablesMock{
+		Pages: []ec2.DescribeRouteTablesOutput{
+			{
+				NextToken: aws.String("page2"),
+				RouteTables: []*ec2.RouteTable{
+					{
+						Routes: []*ec2.Route{
+							{DestinationCidrBlock: aws.String("10.0.0.0/16"), GatewayId: aws.String("local"), State: aws.String("active")},
+							{DestinationCidrBlock: aws.String("10.1.0.0/16"), TransitGatewayId: aws.String("tgw-1"), State: aws.String("active")},
+							{DestinationCidrBlock: aws.String("10.2.0.0/16"), TransitGatewayId: aws.String("tgw-1"), State: aws.String("blackhole")},
+						},
+					},
+				},
+			},
+			{
+				RouteTables: []*ec2.RouteTable{
+					{
+						Routes: []*ec2.Route{
+							{DestinationCidrBlock: aws.String("10.1.0.0/16"), TransitGatewayId: aws.String("tgw-1"), State: aws.String("active")},
+							{DestinationCidrBlock: aws.String("172.16.0.0/12"), TransitGatewayId: aws.String("tgw-2"), State: aws.String("active")},
+							{DestinationCidrBlock: aws.String("0.0.0.0/0"), TransitGatewayId: aws.String("tgw-1"), State: aws.String("active")},
+							{DestinationPrefixListId: aws.String("pl-1234"), TransitGatewayId: aws.String("tgw-1"), State: aws.String("active")},
+						},
+					},
+				},
+			},
+		},
+		PrefixLists: map[string][]*ec2.PrefixListEntry{
+			"pl-1234": {{Cidr: aws.String("192.168.0.0/16")}},
+		},
+	}
+
+	cidrs, err := newTestVpcClient(mock).DescribeVPCTransitGatewayCIDRs("vpc-1234")
+	if err != nil {
+		t.Fatalf("Error returned %v", err)
+	}
+
+	var found []string
+	for _, cidr := range cidrs {
+		found = append(found, cidr.String())
+	}
+	sort.Strings(found)
+	if len(found) != 3 || found[0] != "10.1.0.0/16" || found[1] != "172.16.0.0/12" || found[2] != "192.168.0.0/16" {
+		t.Errorf("Invalid transit gateway CIDRs %v", found)
+	}
+}
+
+type ec2PrefixListMock struct {
+	ec2iface.EC2API
+	Pages []ec2.GetManagedPrefixListEntriesOutput
+}
+
+func (e *ec2PrefixListMock) GetManagedPrefixListEntries(in *ec2.GetManagedPrefixListEntriesInput) (*ec2.GetManagedPrefixListEntriesOutput, error) {
+	page := 0
+	if in.NextToken != nil {
+		page = 1
+	}
+	return &e.Pages[page], nil
+}
+
+func TestDescribePrefixListCIDRs(t *testing.T) {
+	mock := &ec2PrefixListMock{
+		Pages: []ec2.GetManagedPrefixListEntriesOutput{
+			{
+				NextToken: aws.String("page2"),
+				Entries: []*ec2.PrefixListEntry{
+					{Cidr: aws.String("192.168.0.0/16"), Description: aws.String("office")},
+				},
+			},
+			{
+				Entries: []*ec2.PrefixListEntry{
+					{Cidr: aws.String("10.100.0.0/16")},
+				},
+			},
+		},
+	}
+
+	cidrs, err := newTestVpcClient(mock).DescribePrefixListCIDRs("pl-1234")
+	if err != nil {
+		t.Fatalf("Error returned %v", err)
+	}
+	if len(cidrs) != 2 || cidrs[0].String() != "192.168.0.0/16" || cidrs[1].String() != "10.100.0.0/16" {
+		t.Errorf("Invalid prefix list CIDRs %v", cidrs)
+	}
+}
+
+type ec2PeeringMock struct {
+	ec2iface.EC2API
+	Requests []*ec2.DescribeVpcPeeringConnectionsInput
+}
+
+func peering(accepter, requester string, cidrs ...string) *ec2.VpcPeeringConnection {
+	var set []*ec2.CidrBlock
+	for _, cidr := range cidrs {
+		set = append(set, &ec2.CidrBlock{CidrBlock: aws.String(cidr)})
+	}
+	return &ec2.VpcPeeringConnection{
+		AccepterVpcInfo:  &ec2.VpcPeeringConnectionVpcInfo{VpcId: aws.String(accepter), CidrBlockSet: set},
+		RequesterVpcInfo: &ec2.VpcPeeringConnectionVpcInfo{VpcId: aws.String(requester), CidrBlockSet: set},
+	}
+}
+
+func (e *ec2PeeringMock) DescribeVpcPeeringConnections(in *ec2.DescribeVpcPeeringConnectionsInput) (*ec2.DescribeVpcPeeringConnectionsOutput, error) {
+	e.Requests = append(e.Requests, in)
+	switch aws.StringValue(in.Filters[0].Name) {
+	case "accepter-vpc-info.vpc-id":
+		if in.NextToken == nil {
+			return &ec2.DescribeVpcPeeringConnectionsOutput{
+				NextToken:             aws.String("page2"),
+				VpcPeeringConnections: []*ec2.VpcPeeringConnection{peering("vpc-1234", "vpc-a", "10.1.0.0/16")},
+			}, nil
+		}
+		return &ec2.DescribeVpcPeeringConnectionsOutput{
+			VpcPeeringConnections: []*ec2.VpcPeeringConnection{peering("vpc-1234", "vpc-b", "10.2.0.0/16")},
+		}, nil
+	default:
+		return &ec2.DescribeVpcPeeringConnectionsOutput{
+			VpcPeeringConnections: []*ec2.VpcPeeringConnection{peering("vpc-c", "vpc-1234", "10.3.0.0/16", "10.1.0.0/16")},
+		}, nil
+	}
+}
+
+func TestDescribeVPCPeerCIDRs(t *testing.T) {
+	mock := &ec2PeeringMock{}
+	cidrs, err := newTestVpcClient(mock).DescribeVPCPeerCIDRs("vpc-1234", map[string]string{"routing": "pods"})
+	if err != nil {
+		t.Fatalf("Error returned %v", err)
+	}
+
+	var found []string
+	for _, cidr := range cidrs {
+		found = append(found, cidr.String())
+	}
+	sort.Strings(found)
+	if len(found) != 3 || found[0] != "10.1.0.0/16" || found[1] != "10.2.0.0/16" || found[2] != "10.3.0.0/16" {
+		t.Errorf("Invalid peer CIDRs %v", found)
+	}
+
+	if len(mock.Requests) != 3 {
+		t.Fatalf("Expected 3 requests, got %v", len(mock.Requests))
+	}
+	for _, req := range mock.Requests {
+		filters := map[string]string{}
+		for _, filter := range req.Filters {
+			filters[aws.StringValue(filter.Name)] = aws.StringValue(filter.Values[0])
+		}
+		if filters["status-code"] != "active" || filters["tag:routing"] != "pods" {
+			t.Errorf("Invalid filters %v", filters)
+		}
+	}
+}
+
+type ec2RegionPeeringMock struct {
+	ec2iface.EC2API
+}
+
+func (e *ec2RegionPeeringMock) DescribeVpcPeeringConnections(in *ec2.DescribeVpcPeeringConnectionsInput) (*ec2.DescribeVpcPeeringConnectionsOutput, error) {
+	if aws.StringValue(in.Filters[0].Name) != "accepter-vpc-info.vpc-id" {
+		return &ec2.DescribeVpcPeeringConnectionsOutput{}, nil
+	}
+	local := peering("vpc-1234", "vpc-a", "10.1.0.0/16")
+	local.RequesterVpcInfo.Region = aws.String("us-east-1")
+	remote := peering("vpc-1234", "vpc-b", "10.2.0.0/16")
+	remote.RequesterVpcInfo.Region = aws.String("eu-west-1")
+	return &ec2.DescribeVpcPeeringConnectionsOutput{
+		VpcPeeringConnections: []*ec2.VpcPeeringConnection{local, remote},
+	}, nil
+}
+
+func TestDescribeVPCInterRegionPeerCIDRs(t *testing.T) {
+	cidrs, err := newTestVpcClient(&ec2RegionPeeringMock{}).DescribeVPCInterRegionPeerCIDRs("vpc-1234")
+	if err != nil {
+		t.Fatalf("Error returned %v", err)
+	}
+	if len(cidrs) != 1 || cidrs[0].String() != "10.2.0.0/16" {
+		t.Errorf("Invalid inter-region peer CIDRs %v", cidrs)
+	}
+}
+
+func TestExcludeOverlappingCIDRs(t *testing.T) {
+	parse := func(cidrs ...string) (nets []*net.IPNet) {
+		for _, cidr := range cidrs {
+			_, n, _ := net.ParseCIDR(cidr)
+			nets = append(nets, n)
+		}
+		return
+	}
+
+	kept, excluded := ExcludeOverlappingCIDRs(
+		parse("10.0.0.0/8", "10.1.2.0/24", "172.16.0.0/12", "192.168.0.0/16"),
+		parse("10.1.0.0/16", "192.168.10.0/24"))
+	if len(kept) != 1 || kept[0].String() != "172.16.0.0/12" {
+		t.Errorf("Invalid kept CIDRs %v", kept)
+	}
+	if len(excluded) != 3 {
+		t.Errorf("Invalid excluded CIDRs %v", excluded)
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"sort"
 	"strings"
 	"text/tabwriter"
 	"time"
 
+	"github.com/coreos/go-iptables/iptables"
 	"github.com/urfave/cli"
 
 	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
@@ -41,99 +46,88 @@ func filterBuild(input string) (map[string]string, error) {
 }
 
 func actionNewInterface(c *cli.Context) error {
-	return lib.LockfileRun(func() error {
-		filtersRaw := c.String("subnet_filter")
-		filters, err := filterBuild(filtersRaw)
-		if err != nil {
-			fmt.Printf("Invalid filter specification %v", err)
-			return err
-		}
-		ipBatchSize := c.Int64("ip_batch_size")
-
-		secGrps := c.Args()
+	filtersRaw := c.String("subnet_filter")
+	filters, err := filterBuild(filtersRaw)
+	if err != nil {
+		fmt.Printf("Invalid filter specification %v", err)
+		return err
+	}
+	ipBatchSize := c.Int64("ip_batch_size")
 
-		if len(secGrps) <= 0 {
-			fmt.Println("please specify security groups")
-			return fmt.Errorf("need security groups")
-		}
-		newIf, err := aws.DefaultClient.NewInterface(secGrps, filters, ipBatchSize)
-		if err != nil {
-			fmt.Println(err)
-			return err
-		}
-		fmt.Println(newIf)
-		return nil
+	secGrps := c.Args()
 
-	})
+	if len(secGrps) <= 0 {
+		fmt.Println("please specify security groups")
+		return fmt.Errorf("need security groups")
+	}
+	newIf, err := aws.DefaultClient.NewInterface(secGrps, filters, ipBatchSize)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	fmt.Println(newIf)
+	return nil
 }
 
 func actionBugs(c *cli.Context) error {
-	return lib.LockfileRun(func() error {
-		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-		fmt.Fprintln(w, "bug\tafflicted\t")
-		for _, bug := range aws.ListBugs(aws.DefaultClient) {
-			fmt.Fprintf(w, "%s\t%v\t\n", bug.Name, bug.HasBug())
-		}
-		w.Flush()
-		return nil
-	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "bug\tafflicted\t")
+	for _, bug := range aws.ListBugs(aws.DefaultClient) {
+		fmt.Fprintf(w, "%s\t%v\t\n", bug.Name, bug.HasBug())
+	}
+	w.Flush()
+	return nil
 }
 
 func actionRemoveInterface(c *cli.Context) error {
-	return lib.LockfileRun(func() error {
-		interfaces := c.Args()
+	interfaces := c.Args()
 
-		if len(interfaces) <= 0 {
-			fmt.Println("please specify an interface")
-			return fmt.Errorf("Insufficient Arguments")
-		}
+	if len(interfaces) <= 0 {
+		fmt.Println("please specify an interface")
+		return fmt.Errorf("Insufficient Arguments")
+	}
 
-		if err := aws.DefaultClient.RemoveInterface(interfaces); err != nil {
-			fmt.Println(err)
-			return err
-		}
+	if err := aws.DefaultClient.RemoveInterface(interfaces); err != nil {
+		fmt.Println(err)
+		return err
+	}
 
-		return nil
-	})
+	return nil
 }
 
 func actionDeallocate(c *cli.Context) error {
-	return lib.LockfileRun(func() error {
-		releaseIps := c.Args()
-		for _, toRelease := range releaseIps {
+	releaseIps := c.Args()
+	for _, toRelease := range releaseIps {
 
-			if len(toRelease) < 6 {
-				fmt.Println("please specify an IP")
-				return fmt.Errorf("Invalid IP")
-			}
+		if len(toRelease) < 6 {
+			fmt.Println("please specify an IP")
+			return fmt.Errorf("Invalid IP")
+		}
 
-			ip := net.ParseIP(toRelease)
-			if ip == nil {
-				fmt.Println("please specify a valid IP")
-				return fmt.Errorf("IP parse error")
-			}
+		ip := net.ParseIP(toRelease)
+		if ip == nil {
+			fmt.Println("please specify a valid IP")
+			return fmt.Errorf("IP parse error")
+		}
 
-			err := aws.DefaultClient.DeallocateIP(&ip)
-			if err != nil {
-				fmt.Printf("deallocation failed: %v\n", err)
-				return err
-			}
+		err := aws.DefaultClient.DeallocateIP(&ip)
+		if err != nil {
+			fmt.Printf("deallocation failed: %v\n", err)
+			return err
 		}
-		return nil
-	})
+	}
+	return nil
 }
 
 func actionAllocate(c *cli.Context) error {
-	return lib.LockfileRun(func() error {
-		index := c.Int("index")
-		ipBatchSize := c.Int64("ip_batch_size")
-		res, err := aws.DefaultClient.AllocateIPsFirstAvailableAtIndex(index, ipBatchSize)
-		for _, alloc := range res {
-			fmt.Printf("allocated %v on %v\n", alloc.IP, alloc.Interface.LocalName())
-		}
+	index := c.Int("index")
+	ipBatchSize := c.Int64("ip_batch_size")
+	res, err := aws.DefaultClient.AllocateIPsFirstAvailableAtIndex(index, ipBatchSize)
+	for _, alloc := range res {
+		fmt.Printf("allocated %v on %v\n", alloc.IP, alloc.Interface.LocalName())
+	}
 
-		return err
-	})
+	return err
 }
 
 func actionFreeIps(c *cli.Context) error {
@@ -252,6 +246,12 @@ func actionVpcCidr(c *cli.Context) error {
 }
 
 func actionVpcPeerCidr(c *cli.Context) error {
+	peerTags, err := filterBuild(c.String("peer_filter"))
+	if err != nil {
+		fmt.Printf("Invalid filter specification %v", err)
+		return err
+	}
+
 	interfaces, err := aws.DefaultClient.GetInterfaces()
 	if err != nil {
 		fmt.Println(err)
@@ -261,7 +261,7 @@ func actionVpcPeerCidr(c *cli.Context) error {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
 	fmt.Fprintln(w, "iface\tpeer_dcidr\t")
 	for _, iface := range interfaces {
-		apiCidrs, _ := aws.DefaultClient.DescribeVPCPeerCIDRs(iface.VpcID)
+		apiCidrs, _ := aws.DefaultClient.DescribeVPCPeerCIDRs(iface.VpcID, peerTags)
 
 		fmt.Fprintf(w, "%s\t%v\t\n",
 			iface.LocalName(),
@@ -271,6 +271,125 @@ func actionVpcPeerCidr(c *cli.Context) error {
 	return nil
 }
 
+func actionVpcTgwCidr(c *cli.Context) error {
+	interfaces, err := aws.DefaultClient.GetInterfaces()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "iface\ttgw_dcidr\t")
+	for _, iface := range interfaces {
+		apiCidrs, _ := aws.DefaultClient.DescribeVPCTransitGatewayCIDRs(iface.VpcID)
+
+		fmt.Fprintf(w, "%s\t%v\t\n",
+			iface.LocalName(),
+			apiCidrs)
+	}
+	w.Flush()
+	return nil
+}
+
+func actionPrefixListCidr(c *cli.Context) error {
+	prefixLists := c.Args()
+	if len(prefixLists) <= 0 {
+		fmt.Println("please specify a prefix list")
+		return fmt.Errorf("Insufficient Arguments")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "prefix_list\tdcidr\t")
+	for _, prefixList := range prefixLists {
+		apiCidrs, err := aws.DefaultClient.DescribePrefixListCIDRs(prefixList)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+
+		fmt.Fprintf(w, "%s\t%v\t\n",
+			prefixList,
+			apiCidrs)
+	}
+	w.Flush()
+	return nil
+}
+
+// ipamConfig holds the IPAM plugin options selecting Pod routes
+type ipamConfig struct {
+	Type       string `json:"type"`
+	IfaceIndex int    `json:"interfaceIndex"`
+	aws.RouteConf
+}
+
+// parseIpamConfig returns the IPAM plugin options of a network
+// configuration list, or of a single plugin configuration
+func parseIpamConfig(data []byte) (*ipamConfig, error) {
+	var list struct {
+		Plugins []ipamConfig `json:"plugins"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid network configuration: %v", err)
+	}
+	if list.Plugins == nil {
+		var conf ipamConfig
+		if err := json.Unmarshal(data, &conf); err != nil {
+			return nil, fmt.Errorf("invalid network configuration: %v", err)
+		}
+		list.Plugins = append(list.Plugins, conf)
+	}
+	for i := range list.Plugins {
+		if list.Plugins[i].Type == "cni-ipvlan-vpc-k8s-ipam" {
+			return &list.Plugins[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no cni-ipvlan-vpc-k8s-ipam plugin configured")
+}
+
+func actionRoutes(c *cli.Context) error {
+	path := c.String("config")
+	if path == "" {
+		fmt.Println("please specify a network configuration")
+		return fmt.Errorf("Insufficient Arguments")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	conf, err := parseIpamConfig(data)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	interfaces, err := aws.DefaultClient.GetInterfaces()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "iface\tdcidr\t")
+	for _, iface := range interfaces {
+		if iface.Number < conf.IfaceIndex {
+			continue
+		}
+		cidrs, err := aws.PodRouteCIDRs(iface, &conf.RouteConf)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+		for _, cidr := range cidrs {
+			fmt.Fprintf(w, "%s\t%v\t\n",
+				iface.LocalName(),
+				cidr)
+		}
+	}
+	w.Flush()
+	return nil
+}
+
 func actionSubnets(c *cli.Context) error {
 	subnets, err := aws.DefaultClient.GetSubnetsForInstance()
 	if err != nil {
@@ -293,84 +412,456 @@ func actionSubnets(c *cli.Context) error {
 	return nil
 }
 
+// registrySorts order registry entries for registry-list --sort
+var registrySorts = map[string]func(a, b *aws.RegistryEntry) bool{
+	"ip": func(a, b *aws.RegistryEntry) bool {
+		return bytes.Compare(a.IP.To16(), b.IP.To16()) < 0
+	},
+	"state": func(a, b *aws.RegistryEntry) bool { return a.State < b.State },
+	"interface": func(a, b *aws.RegistryEntry) bool {
+		return a.Device < b.Device || (a.Device == b.Device && a.InterfaceID < b.InterfaceID)
+	},
+	"pod":       func(a, b *aws.RegistryEntry) bool { return a.Owner.Pod < b.Owner.Pod },
+	"assigned":  func(a, b *aws.RegistryEntry) bool { return a.AssignedOn.Before(b.AssignedOn) },
+	"released":  func(a, b *aws.RegistryEntry) bool { return a.ReleasedOn.Before(b.ReleasedOn) },
+	"last-seen": func(a, b *aws.RegistryEntry) bool { return a.LastSeen.Before(b.LastSeen) },
+}
+
+// age formats how long ago t was, or "-" if it never was
+func age(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Round(time.Second).String()
+}
+
 func actionRegistryList(c *cli.Context) error {
-	return lib.LockfileRun(func() error {
+	known := make(map[aws.IPState]bool)
+	for _, state := range aws.IPStates {
+		known[state] = true
+	}
+	states := make(map[aws.IPState]bool)
+	if c.String("state") != "" {
+		for _, state := range strings.Split(c.String("state"), ",") {
+			if !known[aws.IPState(state)] {
+				return fmt.Errorf("unknown state %v", state)
+			}
+			states[aws.IPState(state)] = true
+		}
+	}
+	less, ok := registrySorts[c.String("sort")]
+	if !ok {
+		return fmt.Errorf("unknown sort %v", c.String("sort"))
+	}
 
-		reg := &aws.Registry{}
-		ips, err := reg.List()
-		if err != nil {
+	entries, err := (&aws.Registry{}).Entries()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return less(&entries[i], &entries[j]) })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ip\tstate\tinterface\tdevice\tcontainer\tpod\tassigned\treleased\tlast_seen\t")
+	for _, entry := range entries {
+		if len(states) > 0 && !states[entry.State] {
+			continue
+		}
+		device := "-"
+		if entry.InterfaceID != "" {
+			device = fmt.Sprintf("%d", entry.Device)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n",
+			entry.IP,
+			entry.State,
+			entry.InterfaceID,
+			device,
+			entry.Owner.ContainerID,
+			entry.Owner.Pod,
+			age(entry.AssignedOn),
+			age(entry.ReleasedOn),
+			age(entry.LastSeen))
+	}
+	w.Flush()
+	return nil
+}
+
+func actionInUseList(c *cli.Context) error {
+	if c.Bool("reconcile") {
+		if err := aws.ReconcileInUseIPs(); err != nil {
 			return err
 		}
-		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-		fmt.Fprintln(w, "ip\t")
-		for _, ip := range ips {
-			fmt.Fprintf(w, "%v\t\n",
-				ip)
+	}
+
+	ips, scan, err := (&lib.InUseIPs{}).List()
+	if err != nil {
+		return err
+	}
+	if scan != nil {
+		fmt.Printf("last scan %v ago took %v for %v namespaces, %v ips\n",
+			time.Since(scan.ScannedOn.Time).Round(time.Second),
+			scan.Duration,
+			scan.Namespaces,
+			scan.IPs)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ip\tcontainer\tage\t")
+	for _, ip := range ips {
+		fmt.Fprintf(w, "%v\t%v\t%v\t\n",
+			ip.IP,
+			ip.ContainerID,
+			time.Since(ip.AssignedOn.Time).Round(time.Second))
+	}
+	w.Flush()
+	return nil
+}
+
+func actionLocks(c *cli.Context) error {
+	holders, err := lib.LockHolders("")
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "scope\tpid\tcontainer\theld\tcommand\t")
+	for _, holder := range holders {
+		held := ""
+		if !holder.HeldSince.IsZero() {
+			held = time.Since(holder.HeldSince.Time).Round(time.Millisecond).String()
 		}
-		w.Flush()
-		return nil
-	})
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t\n",
+			holder.Scope,
+			holder.PID,
+			holder.Container,
+			held,
+			holder.Command)
+	}
+	w.Flush()
+	return nil
 }
 
 func actionRegistryGc(c *cli.Context) error {
-	return lib.LockfileRun(func() error {
+	maxReap := c.Int("max-reap")
+
+	if err := aws.ReconcileAfterBoot(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to reconcile state after boot due to %v\n", err)
+	}
+
+	reg := &aws.Registry{}
+	freeAfter := c.Duration("free-after")
+	if freeAfter <= 0*time.Second {
+		fmt.Fprintf(os.Stderr,
+			"Invalid duration specified. free-after must be > 0 seconds. Got %v. Please specify with --free-after=[time]\n", freeAfter)
+		return fmt.Errorf("invalid duration")
+	}
+
+	// Insert free-after jitter of 15% of the period
+	freeAfter = aws.Jitter(freeAfter, 0.15)
+
+	// Invert free-after
+	freeAfter *= -1
+
+	now := time.Now()
+	ips, err := reg.TrackedBefore(now.Add(freeAfter))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	// retry IPs whose deallocation was interrupted
+	deallocating, err := reg.IPsInState(aws.IPStateDeallocating)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	ips = append(ips, deallocating...)
+
+	// grab a list of in-use IPs to sanity check
+	assigned, err := nl.GetIPs()
+	if err != nil {
+		return err
+	}
+
+OUTER:
+	for i, ip := range ips {
+		// mark IPs that are actually in use and skip over
+		for _, assignedIP := range assigned {
+			if assignedIP.IPNet.IP.Equal(ip) {
+				err = reg.ObserveIPs([]aws.ObservedIP{{IP: ip, InUse: true}})
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "failed to mark %v in use due to %v", ip, err)
+				}
+				continue OUTER
+			}
+		}
+		// claim the IP, unless an ADD reused it since it was listed
+		claimed, err := reg.ClaimIPForDeallocation(ip, now.Add(freeAfter))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to mark %v deallocating due to %v", ip, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		// return any Elastic IP left on the IP to its pool
+		err = aws.ReleasePodElasticIP(ip)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't disassociate Elastic IP from %v due to %v", ip, err)
+			_ = reg.AbortDeallocation(ip)
+			continue
+		}
+		err = aws.DefaultClient.DeallocateIP(&ips[i])
+		if err == nil {
+			err = reg.ForgetIP(ip)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to forget %v due to %v", ip, err)
+			}
+			maxReap--
+		} else {
+			fmt.Fprintf(os.Stderr, "Can't deallocate %v due to %v", ip, err)
+			_ = reg.AbortDeallocation(ip)
+		}
+		// max-reap specified as negative number will never reach 0 and reap all unused IPs
+		if maxReap == 0 {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func actionRegistryMigrate(c *cli.Context) error {
+	from, err := (&aws.Registry{}).Migrate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to migrate registry from schema version %v due to %v\n", from, err)
+		return err
+	}
+	if from == 0 {
+		fmt.Println("no registry to migrate")
+	} else {
+		fmt.Printf("registry migrated from schema version %v\n", from)
+	}
+	return nil
+}
+
+func actionRegistryVerify(c *cli.Context) error {
+	version, problems, err := (&aws.Registry{}).Verify()
+	if err != nil {
+		return err
+	}
+	if version == 0 && len(problems) == 0 {
+		fmt.Println("no registry")
+		return nil
+	}
+	fmt.Printf("registry schema version %v\n", version)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("registry has %v problems", len(problems))
+	}
+	return nil
+}
 
-		maxReap := c.Int("max-reap")
+// routeTableGrace is how long a table may be allocated without rules, as
+// its ADD may still be creating them
+const routeTableGrace = 5 * time.Minute
 
-		reg := &aws.Registry{}
-		freeAfter := c.Duration("free-after")
-		if freeAfter <= 0*time.Second {
-			fmt.Fprintf(os.Stderr,
-				"Invalid duration specified. free-after must be > 0 seconds. Got %v. Please specify with --free-after=[time]\n", freeAfter)
-			return fmt.Errorf("invalid duration")
+func actionRouteTableGc(c *cli.Context) error {
+	stale, err := nl.StaleRouteTables(c.Int("route-table-start"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+
+	tables := &lib.RouteTables{}
+	for _, table := range stale {
+		if lib.ReservedRouteTable(table) {
+			continue
+		}
+		if err := nl.FlushRouteTable(table); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to flush route table %v due to %v\n", table, err)
+			continue
+		}
+		if err := tables.ReleaseTable(table); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to release route table %v due to %v\n", table, err)
+			continue
 		}
+		fmt.Printf("removed route table %v\n", table)
+	}
 
-		// Insert free-after jitter of 15% of the period
-		freeAfter = aws.Jitter(freeAfter, 0.15)
+	// Release tables allocated by ADDs which never created their rules
+	inUse, err := nl.RouteTablesInUse()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	released, err := tables.ReleaseUnused(inUse, time.Now().Add(-routeTableGrace))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	for _, table := range released {
+		// Older allocators may have handed out a reserved table
+		if !lib.ReservedRouteTable(table.Table) {
+			if err := nl.FlushRouteTable(table.Table); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to flush route table %v due to %v\n", table.Table, err)
+			}
+		}
+		fmt.Printf("released route table %v of %v\n", table.Table, table.ContainerID)
+	}
+	return nil
+}
 
-		// Invert free-after
-		freeAfter *= -1
+// egressConfig is the per-namespace egress IP configuration, typically
+// the contents of a ConfigMap mounted on the host
+type egressConfig struct {
+	// Elastic IP allocation to associate with the egress IP, if any
+	AllocationID string `json:"allocationId"`
+}
 
-		ips, err := reg.TrackedBefore(time.Now().Add(freeAfter))
+func parseEgressConfig(data []byte) (map[string]egressConfig, error) {
+	config := make(map[string]egressConfig)
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid egress IP configuration: %v", err)
+	}
+	return config, nil
+}
+
+func actionEgressIPList(c *cli.Context) error {
+	egressIPs, err := (&lib.EgressIPs{}).List()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "namespace\tip\tinterface\tpublic_ip\tallocation\tdraining\t")
+	for _, egress := range egressIPs {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t\n",
+			egress.Namespace,
+			egress.IP,
+			egress.InterfaceID,
+			egress.PublicIP,
+			egress.AllocationID,
+			egress.Draining)
+	}
+	w.Flush()
+	return nil
+}
+
+// snatAddresses returns the addresses IPv4 NAT rules SNAT to, keyed by
+// their string form
+func snatAddresses() (map[string]bool, error) {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	chains, err := ipt.ListChains("nat")
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[string]bool)
+	for _, chain := range chains {
+		rules, err := ipt.List("nat", chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range snatTargets(rules) {
+			addrs[ip.String()] = true
+		}
+	}
+	return addrs, nil
+}
+
+// snatTargets returns the first address of the --to-source option of
+// rules, as listed by iptables -S
+func snatTargets(rules []string) []net.IP {
+	var ips []net.IP
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] != "--to-source" {
+				continue
+			}
+			// Sources may be ranges with ports, as in a.b.c.d-a.b.c.e:1-2
+			source := strings.SplitN(strings.SplitN(fields[i+1], "-", 2)[0], ":", 2)[0]
+			if ip := net.ParseIP(source); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+func actionEgressIPSync(c *cli.Context) error {
+	return lib.WithLockTimeout(lib.LockEgressIPs, func() error {
+		data, err := ioutil.ReadFile(c.String("config"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+		config, err := parseEgressConfig(data)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			return err
 		}
 
-		// grab a list of in-use IPs to sanity check
-		assigned, err := nl.GetIPs()
+		existing, err := (&lib.EgressIPs{}).List()
 		if err != nil {
 			return err
 		}
 
-	OUTER:
-		for i, ip := range ips {
-			// forget IPs that are actually in use and skip over
-			for _, assignedIP := range assigned {
-				if assignedIP.IPNet.IP.Equal(ip) {
-					err = reg.ForgetIP(ip)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "failed to forget %v due to %v", ip, err)
-					}
-					continue OUTER
+		// Running Pods keep the egress IP they were SNATed to at ADD
+		snatted, err := snatAddresses()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+
+		// Keep the private IP of namespaces still configured, replacing
+		// only their Elastic IP if it changed. Release the egress IPs of
+		// namespaces no longer configured once no Pod uses them.
+		current := make(map[string]bool)
+		for _, egress := range existing {
+			if wanted, ok := config[egress.Namespace]; ok {
+				current[egress.Namespace] = true
+				if wanted.AllocationID == egress.AllocationID && !egress.Draining {
+					continue
+				}
+				egress.Draining = false
+				if err := aws.ReassociateEgressIP(egress, wanted.AllocationID); err != nil {
+					fmt.Fprintf(os.Stderr, "failed to update egress IP %v of %v due to %v\n", egress.IP, egress.Namespace, err)
+					continue
 				}
+				fmt.Printf("updated %v of %v\n", egress.IP, egress.Namespace)
+				continue
 			}
-			err := aws.DefaultClient.DeallocateIP(&ips[i])
-			if err == nil {
-				err = reg.ForgetIP(ip)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "failed to forget %v due to %v", ip, err)
+			if snatted[egress.IP.String()] {
+				if !egress.Draining {
+					egress.Draining = true
+					if err := (&lib.EgressIPs{}).Set(egress); err != nil {
+						fmt.Fprintf(os.Stderr, "failed to drain egress IP %v of %v due to %v\n", egress.IP, egress.Namespace, err)
+						continue
+					}
 				}
-				maxReap--
-			} else {
-				fmt.Fprintf(os.Stderr, "Can't deallocate %v due to %v", ip, err)
+				fmt.Printf("draining %v of %v, still used by Pods\n", egress.IP, egress.Namespace)
+				continue
 			}
-			// max-reap specified as negative number will never reach 0 and reap all unused IPs
-			if maxReap == 0 {
-				return nil
+			if err := aws.ReleaseEgressIP(egress); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to release egress IP %v of %v due to %v\n", egress.IP, egress.Namespace, err)
+				continue
 			}
+			fmt.Printf("released %v from %v\n", egress.IP, egress.Namespace)
 		}
 
+		for namespace, wanted := range config {
+			if current[namespace] {
+				continue
+			}
+			egress, err := aws.AllocateEgressIP(namespace, wanted.AllocationID)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to allocate egress IP for %v due to %v\n", namespace, err)
+				continue
+			}
+			fmt.Printf("allocated %v to %v\n", egress.IP, namespace)
+		}
 		return nil
 	})
 }
@@ -476,14 +967,70 @@ func main() {
 			Action: actionVpcCidr,
 		},
 		{
-			Name:   "vpcpeercidr",
-			Usage:  "Show the peered VPC CIDRs associated with current interfaces",
-			Action: actionVpcPeerCidr,
+			Name:      "vpcpeercidr",
+			Usage:     "Show the peered VPC CIDRs associated with current interfaces",
+			Action:    actionVpcPeerCidr,
+			ArgsUsage: "[--peer_filter=k,v]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "peer_filter",
+					Usage: "Comma separated key=value tags to restrict peering connections",
+				},
+			},
+		},
+		{
+			Name:   "vpctgwcidr",
+			Usage:  "Show the CIDRs routed to transit gateways from the VPCs of current interfaces",
+			Action: actionVpcTgwCidr,
+		},
+		{
+			Name:   "routes",
+			Usage:  "Show the routes Pods get on each interface for a network configuration",
+			Action: actionRoutes,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config",
+					Usage: "CNI network configuration or configuration list file",
+				},
+			},
+		},
+		{
+			Name:      "prefixlistcidr",
+			Usage:     "Show the CIDRs of managed prefix lists",
+			Action:    actionPrefixListCidr,
+			ArgsUsage: "[prefix_list_id...]",
 		},
 		{
 			Name:   "registry-list",
-			Usage:  "List all known free IPs in the internal registry",
+			Usage:  "List all known IPs and their states in the internal registry",
 			Action: actionRegistryList,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "state",
+					Usage: "Comma separated states to list: allocating, in-use, free, quarantined, deallocating",
+				},
+				cli.StringFlag{
+					Name:  "sort",
+					Value: "ip",
+					Usage: "Sort by ip, state, interface, pod, assigned, released or last-seen",
+				},
+			},
+		},
+		{
+			Name:   "inuse-list",
+			Usage:  "List the IPs in use by Pods and the last scan of their namespaces",
+			Action: actionInUseList,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "reconcile",
+					Usage: "Scan the network namespaces before listing",
+				},
+			},
+		},
+		{
+			Name:   "locks",
+			Usage:  "List the held locks and the processes holding them",
+			Action: actionLocks,
 		},
 		{
 			Name:   "registry-gc",
@@ -501,6 +1048,60 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:   "registry-migrate",
+			Usage:  "Rewrite the registry in the current schema version",
+			Action: actionRegistryMigrate,
+		},
+		{
+			Name:   "registry-verify",
+			Usage:  "Check that the registry can be loaded without being reset",
+			Action: actionRegistryVerify,
+		},
+		{
+			Name:   "egress-ip-list",
+			Usage:  "List the egress IPs assigned to namespaces",
+			Action: actionEgressIPList,
+		},
+		{
+			Name:   "egress-ip-sync",
+			Usage:  "Allocate and release namespace egress IPs on the boot ENI to match a configuration file",
+			Action: actionEgressIPSync,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config",
+					Usage: "JSON file mapping namespaces to their egress settings, e.g. a mounted ConfigMap",
+				},
+			},
+		},
+		{
+			Name:   "route-table-gc",
+			Usage:  "Remove policy routing tables and rules whose veth no longer exists, and tables without rules",
+			Action: actionRouteTableGc,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "route-table-start",
+					Value: 256,
+					Usage: "Lowest route table considered, matching routeTableStart of the unnumbered-ptp plugin",
+				},
+			},
+		},
+	}
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "namespace-sources",
+			Usage: "Comma separated sources of container network namespaces: netns[:dir], docker, cri[:socket], proc",
+			Value: strings.Join(nl.DefaultNamespaceSources, ","),
+		},
+		cli.StringFlag{
+			Name:  "state-dir",
+			Usage: "Directory of the registry and the state shared with the plugins",
+			Value: lib.StatePath(),
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		lib.SetStatePath(c.GlobalString("state-dir"))
+		return nl.SetNamespaceSources(strings.Split(c.GlobalString("namespace-sources"), ","))
 	}
 	app.Version = version
 	app.Copyright = "(c) 2017-2018 Lyft Inc."
@@ -37,3 +37,57 @@ func TestFilterBuildMulti(t *testing.T) {
 	}
 
 }
+
+// TestParseEgressConfig tests namespace egress configuration parsing
+func TestParseEgressConfig(t *testing.T) {
+	config, err := parseEgressConfig([]byte(`{"team-a": {}, "team-b": {"allocationId": "eipalloc-1234"}}`))
+	if err != nil {
+		t.Fatalf("Error returned %v", err)
+	}
+	if len(config) != 2 {
+		t.Errorf("Invalid number of namespaces %v", config)
+	}
+	if config["team-b"].AllocationID != "eipalloc-1234" {
+		t.Errorf("Invalid allocation for team-b %v", config["team-b"])
+	}
+
+	if _, err := parseEgressConfig([]byte(`["team-a"]`)); err == nil {
+		t.Errorf("Invalid configuration accepted")
+	}
+}
+
+// TestParseIpamConfig tests finding the IPAM options in a network configuration
+func TestParseIpamConfig(t *testing.T) {
+	conf, err := parseIpamConfig([]byte(`{
+		"cniVersion": "0.3.1",
+		"name": "cni-ipvlan-vpc-k8s",
+		"plugins": [
+			{"type": "cni-ipvlan-vpc-k8s-ipam", "interfaceIndex": 1, "routeToVpcPeers": true, "maxRoutes": 50},
+			{"type": "cni-ipvlan-vpc-k8s-ipvlan"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("Error returned %v", err)
+	}
+	if conf.IfaceIndex != 1 || !conf.RouteToVPCPeers || conf.MaxRoutes != 50 {
+		t.Errorf("Invalid IPAM configuration %+v", conf)
+	}
+
+	if _, err = parseIpamConfig([]byte(`{"type": "cni-ipvlan-vpc-k8s-ipvlan"}`)); err == nil {
+		t.Errorf("Configuration without IPAM plugin accepted")
+	}
+}
+
+// TestSnatTargets tests finding the addresses of SNAT rules
+func TestSnatTargets(t *testing.T) {
+	ips := snatTargets([]string{
+		"-N CNI-1234",
+		"-A CNI-1234 -d 10.0.0.5/32 -m comment --comment \"name: cni\" -j ACCEPT",
+		"-A CNI-1234 ! -d 224.0.0.0/4 -m comment --comment \"name: cni\" -j SNAT --to-source 10.0.0.9",
+		"-A CNI-5678 -j SNAT --to-source 10.0.1.1-10.0.1.4:1024-2048",
+		"-A CNI-9abc -j MASQUERADE",
+	})
+	if len(ips) != 2 || ips[0].String() != "10.0.0.9" || ips[1].String() != "10.0.1.1" {
+		t.Errorf("Invalid SNAT addresses %v", ips)
+	}
+}
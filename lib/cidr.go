@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+// AggregateCIDRs returns the smallest set of CIDRs covering exactly the
+// same addresses as cidrs: duplicates and CIDRs contained in others are
+// dropped, and adjacent CIDRs are merged into their supernet
+func AggregateCIDRs(cidrs []*net.IPNet) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		ip := cidr.IP.To4()
+		if ip == nil {
+			ip = cidr.IP.To16()
+		}
+		ones, bits := cidr.Mask.Size()
+		if ip == nil || bits != len(ip)*8 {
+			continue
+		}
+		mask := net.CIDRMask(ones, bits)
+		nets = append(nets, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+
+	// IPv4 first, then by address and shortest prefix first, so a CIDR
+	// can only be contained in the one kept before it
+	sort.Slice(nets, func(i, j int) bool {
+		if len(nets[i].IP) != len(nets[j].IP) {
+			return len(nets[i].IP) < len(nets[j].IP)
+		}
+		if c := bytes.Compare(nets[i].IP, nets[j].IP); c != 0 {
+			return c < 0
+		}
+		oi, _ := nets[i].Mask.Size()
+		oj, _ := nets[j].Mask.Size()
+		return oi < oj
+	})
+
+	var aggregated []*net.IPNet
+	for _, n := range nets {
+		if last := len(aggregated) - 1; last >= 0 {
+			prev := aggregated[last]
+			if len(prev.IP) == len(n.IP) && prev.Contains(n.IP) {
+				continue
+			}
+		}
+		aggregated = append(aggregated, n)
+		for len(aggregated) > 1 {
+			last := len(aggregated) - 1
+			supernet := mergeCIDRs(aggregated[last-1], aggregated[last])
+			if supernet == nil {
+				break
+			}
+			aggregated = append(aggregated[:last-1], supernet)
+		}
+	}
+	return aggregated
+}
+
+// mergeCIDRs returns the supernet of a and b if they are its two halves
+func mergeCIDRs(a, b *net.IPNet) *net.IPNet {
+	if len(a.IP) != len(b.IP) {
+		return nil
+	}
+	onesA, bits := a.Mask.Size()
+	onesB, _ := b.Mask.Size()
+	if onesA != onesB || onesA == 0 || a.IP.Equal(b.IP) {
+		return nil
+	}
+	mask := net.CIDRMask(onesA-1, bits)
+	if !a.IP.Mask(mask).Equal(a.IP) || !b.IP.Mask(mask).Equal(a.IP) {
+		return nil
+	}
+	return &net.IPNet{IP: a.IP, Mask: mask}
+}
+
+// AggregateRoutes aggregates each group of CIDRs on its own, so CIDRs of
+// different groups, e.g. reached through different paths, are never
+// merged. It returns the CIDRs of all groups in order, without those
+// already in an earlier group. If max is positive, only the first max
+// CIDRs are kept and the others are returned as dropped.
+func AggregateRoutes(groups [][]*net.IPNet, max int) (kept []*net.IPNet, dropped []*net.IPNet) {
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		var fresh []*net.IPNet
+		for _, cidr := range group {
+			masked := net.IPNet{IP: cidr.IP.Mask(cidr.Mask), Mask: cidr.Mask}
+			if !seen[masked.String()] {
+				fresh = append(fresh, cidr)
+			}
+		}
+		for _, cidr := range AggregateCIDRs(fresh) {
+			if seen[cidr.String()] {
+				continue
+			}
+			seen[cidr.String()] = true
+			if max > 0 && len(kept) >= max {
+				dropped = append(dropped, cidr)
+			} else {
+				kept = append(kept, cidr)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAggregateCIDRs(t *testing.T) {
+	tests := []struct {
+		in  []string
+		out []string
+	}{
+		{nil, nil},
+		{[]string{"10.0.0.0/16", "10.0.0.0/16"}, []string{"10.0.0.0/16"}},
+		{[]string{"10.0.1.0/24", "10.0.0.0/16"}, []string{"10.0.0.0/16"}},
+		{[]string{"10.1.0.0/16", "10.0.0.0/16"}, []string{"10.0.0.0/15"}},
+		{[]string{"10.1.0.0/16", "10.2.0.0/16"}, []string{"10.1.0.0/16", "10.2.0.0/16"}},
+		{
+			[]string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/23", "172.16.0.0/12"},
+			[]string{"10.0.0.0/22", "172.16.0.0/12"},
+		},
+		{[]string{"10.0.0.5/24", "10.0.1.0/24"}, []string{"10.0.0.0/23"}},
+		{[]string{"fd00::/8", "10.0.0.0/8"}, []string{"10.0.0.0/8", "fd00::/8"}},
+	}
+
+	for _, test := range tests {
+		var in []*net.IPNet
+		for _, cidr := range test.in {
+			ip, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Keep host bits to check they are masked off
+			n.IP = ip
+			in = append(in, n)
+		}
+
+		out := AggregateCIDRs(in)
+		if len(out) != len(test.out) {
+			t.Errorf("AggregateCIDRs(%v) = %v, want %v", test.in, out, test.out)
+			continue
+		}
+		for i := range out {
+			if out[i].String() != test.out[i] {
+				t.Errorf("AggregateCIDRs(%v) = %v, want %v", test.in, out, test.out)
+				break
+			}
+		}
+	}
+}
+
+func TestAggregateRoutes(t *testing.T) {
+	parse := func(cidrs ...string) (nets []*net.IPNet) {
+		for _, cidr := range cidrs {
+			_, n, _ := net.ParseCIDR(cidr)
+			nets = append(nets, n)
+		}
+		return
+	}
+	groups := [][]*net.IPNet{
+		parse("10.0.0.0/16"),
+		// Adjacent to the first group, but not merged with it
+		parse("10.1.0.0/16", "10.0.0.0/16"),
+		parse("172.16.0.0/13", "172.24.0.0/13", "192.168.0.0/16"),
+	}
+
+	kept, dropped := AggregateRoutes(groups, 0)
+	if len(dropped) != 0 || len(kept) != 4 || kept[0].String() != "10.0.0.0/16" ||
+		kept[1].String() != "10.1.0.0/16" || kept[2].String() != "172.16.0.0/12" {
+		t.Errorf("Invalid routes %v dropped %v", kept, dropped)
+	}
+
+	kept, dropped = AggregateRoutes(groups, 3)
+	if len(kept) != 3 || len(dropped) != 1 || dropped[0].String() != "192.168.0.0/16" {
+		t.Errorf("Invalid capped routes %v dropped %v", kept, dropped)
+	}
+}
@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// MergeDNS merges the DNS settings of a plugin into those of the result
+// of the previous plugin in the chain. Nameservers, search domains and
+// options of dns come first, its domain takes precedence, and duplicates
+// are dropped.
+func MergeDNS(prev types.DNS, dns types.DNS) types.DNS {
+	merged := types.DNS{
+		Nameservers: mergeStrings(dns.Nameservers, prev.Nameservers),
+		Domain:      dns.Domain,
+		Search:      mergeStrings(dns.Search, prev.Search),
+		Options:     mergeStrings(dns.Options, prev.Options),
+	}
+	if merged.Domain == "" {
+		merged.Domain = prev.Domain
+	}
+	return merged
+}
+
+func mergeStrings(lists ...[]string) []string {
+	var merged []string
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, s := range list {
+			if !seen[s] {
+				seen[s] = true
+				merged = append(merged, s)
+			}
+		}
+	}
+	return merged
+}
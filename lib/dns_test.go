@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestMergeDNS(t *testing.T) {
+	prev := types.DNS{
+		Nameservers: []string{"10.0.0.2"},
+		Domain:      "ec2.internal",
+		Search:      []string{"ec2.internal"},
+	}
+
+	merged := MergeDNS(prev, types.DNS{})
+	if !reflect.DeepEqual(merged, prev) {
+		t.Errorf("Empty DNS changed the previous result: %+v", merged)
+	}
+
+	merged = MergeDNS(prev, types.DNS{
+		Nameservers: []string{"169.254.20.10", "10.0.0.2"},
+		Search:      []string{"svc.cluster.local"},
+		Options:     []string{"ndots:5"},
+	})
+	expected := types.DNS{
+		Nameservers: []string{"169.254.20.10", "10.0.0.2"},
+		Domain:      "ec2.internal",
+		Search:      []string{"svc.cluster.local", "ec2.internal"},
+		Options:     []string{"ndots:5"},
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Invalid merged DNS %+v, expected %+v", merged, expected)
+	}
+
+	merged = MergeDNS(prev, types.DNS{Domain: "cluster.local"})
+	if merged.Domain != "cluster.local" {
+		t.Errorf("Plugin domain not preferred: %v", merged.Domain)
+	}
+}
@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"net"
+	"sort"
+)
+
+const (
+	egressIPsFile          = "egress-ips.json"
+	egressIPsSchemaVersion = 1
+)
+
+// EgressIP is a dedicated address Pods of a namespace are SNATed to
+type EgressIP struct {
+	Namespace     string `json:"namespace"`
+	IP            net.IP `json:"ip"`
+	InterfaceID   string `json:"interface_id"`
+	AllocationID  string `json:"allocation_id,omitempty"`
+	AssociationID string `json:"association_id,omitempty"`
+	PublicIP      net.IP `json:"public_ip,omitempty"`
+	// Draining egress IPs are no longer configured, and are only kept
+	// until no running Pod is SNATed to them. New Pods don't get them.
+	Draining bool `json:"draining,omitempty"`
+}
+
+type egressIPsContents struct {
+	SchemaVersion int                  `json:"schema_version"`
+	Namespaces    map[string]*EgressIP `json:"namespaces"`
+}
+
+// EgressIPs is the local cache of per-namespace egress IPs, shared between
+// the tool which assigns them and the plugins which SNAT to them
+type EgressIPs struct {
+	path string
+}
+
+func (e *EgressIPs) locked(write bool, fn func(contents *egressIPsContents) error) error {
+	contents := egressIPsContents{}
+	return lockedStateFile(e.path, egressIPsFile, write, &contents, func() error {
+		if contents.Namespaces == nil {
+			contents.Namespaces = map[string]*EgressIP{}
+		}
+		contents.SchemaVersion = egressIPsSchemaVersion
+		return fn(&contents)
+	})
+}
+
+// Get returns the egress IP of a namespace, or nil if it has none
+func (e *EgressIPs) Get(namespace string) (egress *EgressIP, err error) {
+	err = e.locked(false, func(contents *egressIPsContents) error {
+		egress = contents.Namespaces[namespace]
+		return nil
+	})
+	return
+}
+
+// Set records the egress IP of a namespace
+func (e *EgressIPs) Set(egress *EgressIP) error {
+	return e.locked(true, func(contents *egressIPsContents) error {
+		contents.Namespaces[egress.Namespace] = egress
+		return nil
+	})
+}
+
+// Remove forgets the egress IP of a namespace
+func (e *EgressIPs) Remove(namespace string) error {
+	return e.locked(true, func(contents *egressIPsContents) error {
+		delete(contents.Namespaces, namespace)
+		return nil
+	})
+}
+
+// List returns all egress IPs, sorted by namespace
+func (e *EgressIPs) List() (ret []*EgressIP, err error) {
+	err = e.locked(false, func(contents *egressIPsContents) error {
+		for _, egress := range contents.Namespaces {
+			ret = append(ret, egress)
+		}
+		return nil
+	})
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Namespace < ret[j].Namespace })
+	return
+}
@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestEgressIPs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "egress")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	e := &EgressIPs{path: dir}
+
+	if egress, err := e.Get("default"); egress != nil || err != nil {
+		t.Fatalf("expected no egress IP, got %v %v", egress, err)
+	}
+
+	err = e.Set(&EgressIP{Namespace: "default", IP: net.ParseIP("10.0.0.5"), InterfaceID: "eni-1"})
+	if err != nil {
+		t.Fatalf("set failed %v", err)
+	}
+
+	egress, err := e.Get("default")
+	if err != nil || egress == nil || !egress.IP.Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatalf("egress IP not returned: %v %v", egress, err)
+	}
+	if list, _ := e.List(); len(list) != 1 {
+		t.Fatalf("expected one egress IP, got %v", list)
+	}
+
+	if err := e.Remove("default"); err != nil {
+		t.Fatalf("remove failed %v", err)
+	}
+	if list, _ := e.List(); len(list) != 0 {
+		t.Fatalf("expected no egress IPs, got %v", list)
+	}
+}
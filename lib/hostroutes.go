@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+const (
+	hostRoutesFile          = "host-routes.json"
+	hostRoutesSchemaVersion = 1
+)
+
+type hostRoutesContents struct {
+	SchemaVersion int                 `json:"schema_version"`
+	Containers    map[string][]net.IP `json:"containers"`
+}
+
+// HostRoutes records the Pod addresses host routes were added for, by
+// container, so DEL can remove them once the network namespace is gone
+type HostRoutes struct {
+	path string
+}
+
+func (h *HostRoutes) locked(write bool, fn func(contents *hostRoutesContents) error) error {
+	contents := hostRoutesContents{}
+	return lockedStateFile(h.path, hostRoutesFile, write, &contents, func() error {
+		if contents.Containers == nil {
+			contents.Containers = map[string][]net.IP{}
+		}
+		contents.SchemaVersion = hostRoutesSchemaVersion
+		return fn(&contents)
+	})
+}
+
+// Add records host routes to ips for a container
+func (h *HostRoutes) Add(containerID string, ips []net.IP) error {
+	return h.locked(true, func(contents *hostRoutesContents) error {
+		recorded := contents.Containers[containerID]
+	next:
+		for _, ip := range ips {
+			for _, known := range recorded {
+				if known.Equal(ip) {
+					continue next
+				}
+			}
+			recorded = append(recorded, ip)
+		}
+		sort.Slice(recorded, func(i, j int) bool { return bytes.Compare(recorded[i].To16(), recorded[j].To16()) < 0 })
+		contents.Containers[containerID] = recorded
+		return nil
+	})
+}
+
+// Lookup returns the addresses host routes were recorded for by a
+// container
+func (h *HostRoutes) Lookup(containerID string) (ips []net.IP, err error) {
+	err = h.locked(false, func(contents *hostRoutesContents) error {
+		ips = contents.Containers[containerID]
+		return nil
+	})
+	return
+}
+
+// Remove forgets the host routes of a container
+func (h *HostRoutes) Remove(containerID string) error {
+	return h.locked(true, func(contents *hostRoutesContents) error {
+		delete(contents.Containers, containerID)
+		return nil
+	})
+}
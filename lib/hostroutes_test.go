@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestHostRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostroutes")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	h := &HostRoutes{path: dir}
+
+	if err := h.Add("container-1", []net.IP{net.ParseIP("10.0.1.5")}); err != nil {
+		t.Fatalf("add failed %v", err)
+	}
+	// A retried ADD records its addresses again
+	if err := h.Add("container-1", []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("10.0.1.5")}); err != nil {
+		t.Fatalf("add failed %v", err)
+	}
+	ips, err := h.Lookup("container-1")
+	if err != nil || len(ips) != 2 || !ips[0].Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatalf("expected 2 recorded IPs, got %v %v", ips, err)
+	}
+
+	if err := h.Remove("container-1"); err != nil {
+		t.Fatalf("remove failed %v", err)
+	}
+	if ips, err := h.Lookup("container-1"); err != nil || len(ips) != 0 {
+		t.Fatalf("expected no recorded IPs, got %v %v", ips, err)
+	}
+}
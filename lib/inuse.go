@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	inUseIPsFile          = "in-use-ips.json"
+	inUseIPsSchemaVersion = 1
+)
+
+// InUseIP is a Pod IP, recorded when it is handed out by ADD or found by
+// a namespace scan
+type InUseIP struct {
+	IP          net.IP   `json:"ip"`
+	ContainerID string   `json:"container_id,omitempty"`
+	AssignedOn  JSONTime `json:"assigned_on"`
+}
+
+// NamespaceScan describes a reconciliation of the in-use IPs with the
+// network namespaces on the host
+type NamespaceScan struct {
+	ScannedOn  JSONTime      `json:"scanned_on"`
+	Duration   time.Duration `json:"duration"`
+	Namespaces int           `json:"namespaces"`
+	IPs        int           `json:"ips"`
+}
+
+// ScanFunc returns the IPs in the network namespaces on the host, and how
+// many namespaces were scanned
+type ScanFunc func() ([]net.IP, int, error)
+
+type inUseIPsContents struct {
+	SchemaVersion int                 `json:"schema_version"`
+	IPs           map[string]*InUseIP `json:"ips"`
+	LastScan      *NamespaceScan      `json:"last_scan,omitempty"`
+}
+
+// InUseIPs is the inventory of Pod IPs kept by ADD and DEL, so finding
+// the IPs in use does not require entering every network namespace.
+// It is periodically reconciled with a namespace scan to catch Pods torn
+// down without a DEL.
+type InUseIPs struct {
+	path string
+}
+
+func (u *InUseIPs) locked(write bool, fn func(contents *inUseIPsContents) error) error {
+	contents := inUseIPsContents{}
+	return lockedStateFile(u.path, inUseIPsFile, write, &contents, func() error {
+		if contents.IPs == nil {
+			contents.IPs = map[string]*InUseIP{}
+		}
+		contents.SchemaVersion = inUseIPsSchemaVersion
+		return fn(&contents)
+	})
+}
+
+// Add records an IP as in use by a container
+func (u *InUseIPs) Add(ip net.IP, containerID string) error {
+	return u.locked(true, func(contents *inUseIPsContents) error {
+		contents.IPs[ip.String()] = &InUseIP{
+			IP:          ip,
+			ContainerID: containerID,
+			AssignedOn:  JSONTime{Time: time.Now()},
+		}
+		return nil
+	})
+}
+
+// Remove forgets an in-use IP
+func (u *InUseIPs) Remove(ip net.IP) error {
+	return u.locked(true, func(contents *inUseIPsContents) error {
+		delete(contents.IPs, ip.String())
+		return nil
+	})
+}
+
+// Lookup returns the record of an in-use IP, or nil if it is not in use
+func (u *InUseIPs) Lookup(ip net.IP) (inUse *InUseIP, err error) {
+	err = u.locked(false, func(contents *inUseIPsContents) error {
+		inUse = contents.IPs[ip.String()]
+		return nil
+	})
+	return
+}
+
+// ContainerIPs returns the in-use IPs handed out to a container
+func (u *InUseIPs) ContainerIPs(containerID string) (ret []net.IP, err error) {
+	err = u.locked(false, func(contents *inUseIPsContents) error {
+		for _, inUse := range contents.IPs {
+			if inUse.ContainerID == containerID {
+				ret = append(ret, inUse.IP)
+			}
+		}
+		return nil
+	})
+	sort.Slice(ret, func(i, j int) bool { return bytes.Compare(ret[i].To16(), ret[j].To16()) < 0 })
+	return
+}
+
+// List returns all in-use IPs sorted by IP, and the last namespace scan
+// if there was one
+func (u *InUseIPs) List() (ret []*InUseIP, scan *NamespaceScan, err error) {
+	err = u.locked(false, func(contents *inUseIPsContents) error {
+		for _, inUse := range contents.IPs {
+			ret = append(ret, inUse)
+		}
+		scan = contents.LastScan
+		return nil
+	})
+	sort.Slice(ret, func(i, j int) bool { return bytes.Compare(ret[i].IP.To16(), ret[j].IP.To16()) < 0 })
+	return
+}
+
+// Reconciled returns the in-use IPs, first reconciling them with scan if
+// the last scan is older than interval. IPs found by the scan are added,
+// and IPs it missed are dropped unless they were handed out within grace,
+// as their Pod may not have its addresses configured yet. The scan runs
+// without holding the inventory, so ADDs and DELs don't wait for it.
+func (u *InUseIPs) Reconciled(interval, grace time.Duration, scan ScanFunc) (ret []net.IP, err error) {
+	due := false
+	recorded := make(map[string]bool)
+	err = u.locked(false, func(contents *inUseIPsContents) error {
+		due = contents.LastScan == nil || !contents.LastScan.ScannedOn.After(time.Now().Add(-interval))
+		for key, inUse := range contents.IPs {
+			recorded[key] = true
+			ret = append(ret, inUse.IP)
+		}
+		return nil
+	})
+	if err != nil || !due {
+		return
+	}
+
+	start := time.Now()
+	found, namespaces, err := scan()
+	if err != nil {
+		return nil, err
+	}
+	duration := time.Since(start)
+
+	ret = nil
+	err = u.locked(true, func(contents *inUseIPsContents) error {
+		// IPs removed by a DEL during the scan may still have been found
+		var kept []net.IP
+		for _, ip := range found {
+			if _, ok := contents.IPs[ip.String()]; ok || !recorded[ip.String()] {
+				kept = append(kept, ip)
+			}
+		}
+		// and IPs added by an ADD during the scan are within grace
+		reconcile(contents, kept, start.Add(-grace))
+		contents.LastScan = &NamespaceScan{
+			ScannedOn:  JSONTime{Time: start},
+			Duration:   duration,
+			Namespaces: namespaces,
+			IPs:        len(found),
+		}
+
+		for _, inUse := range contents.IPs {
+			ret = append(ret, inUse.IP)
+		}
+		return nil
+	})
+	return
+}
+
+// reconcile replaces the in-use IPs of contents by the found ones, keeping
+// the records of known IPs and any IP handed out after since
+func reconcile(contents *inUseIPsContents, found []net.IP, since time.Time) {
+	ips := make(map[string]*InUseIP, len(found))
+	for _, ip := range found {
+		inUse, ok := contents.IPs[ip.String()]
+		if !ok {
+			inUse = &InUseIP{IP: ip, AssignedOn: JSONTime{Time: time.Now()}}
+		}
+		ips[ip.String()] = inUse
+	}
+	for key, inUse := range contents.IPs {
+		if _, ok := ips[key]; !ok && inUse.AssignedOn.After(since) {
+			ips[key] = inUse
+		}
+	}
+	contents.IPs = ips
+}
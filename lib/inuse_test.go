@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestInUseIPs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inuse")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	u := &InUseIPs{path: dir}
+
+	scans := 0
+	scanned := []net.IP{net.ParseIP("10.0.0.6")}
+	scan := func() ([]net.IP, int, error) {
+		scans++
+		return scanned, 1, nil
+	}
+
+	if err := u.Add(net.ParseIP("10.0.0.5"), "container-1"); err != nil {
+		t.Fatalf("add failed %v", err)
+	}
+
+	// The first lookup scans, keeping the IP just handed out
+	ips, err := u.Reconciled(time.Hour, time.Minute, scan)
+	if err != nil || len(ips) != 2 || scans != 1 {
+		t.Fatalf("expected 2 IPs after a scan, got %v %v after %v scans", ips, err, scans)
+	}
+
+	// Later ones use the inventory until the interval passes
+	if err := u.Remove(net.ParseIP("10.0.0.5")); err != nil {
+		t.Fatalf("remove failed %v", err)
+	}
+	ips, err = u.Reconciled(time.Hour, time.Minute, scan)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.6")) || scans != 1 {
+		t.Fatalf("expected the inventory without a scan, got %v %v after %v scans", ips, err, scans)
+	}
+
+	if err := u.Add(net.ParseIP("10.0.0.7"), "container-2"); err != nil {
+		t.Fatalf("add failed %v", err)
+	}
+	if inUse, err := u.Lookup(net.ParseIP("10.0.0.7")); err != nil || inUse == nil || inUse.ContainerID != "container-2" {
+		t.Fatalf("unexpected lookup %v %v", inUse, err)
+	}
+	containerIPs, err := u.ContainerIPs("container-2")
+	if err != nil || len(containerIPs) != 1 || !containerIPs[0].Equal(net.ParseIP("10.0.0.7")) {
+		t.Fatalf("unexpected container IPs %v %v", containerIPs, err)
+	}
+	if err := u.Remove(net.ParseIP("10.0.0.7")); err != nil {
+		t.Fatalf("remove failed %v", err)
+	}
+
+	list, scanInfo, err := u.List()
+	if err != nil || len(list) != 1 || scanInfo == nil || scanInfo.Namespaces != 1 || scanInfo.IPs != 1 {
+		t.Fatalf("unexpected list %v %v %v", list, scanInfo, err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	now := time.Now()
+	contents := &inUseIPsContents{IPs: map[string]*InUseIP{
+		"10.0.0.1": {IP: net.ParseIP("10.0.0.1"), ContainerID: "found", AssignedOn: JSONTime{Time: now.Add(-time.Hour)}},
+		"10.0.0.2": {IP: net.ParseIP("10.0.0.2"), ContainerID: "gone", AssignedOn: JSONTime{Time: now.Add(-time.Hour)}},
+		"10.0.0.3": {IP: net.ParseIP("10.0.0.3"), ContainerID: "new", AssignedOn: JSONTime{Time: now}},
+	}}
+
+	reconcile(contents, []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.4")}, now.Add(-time.Minute))
+
+	if len(contents.IPs) != 3 {
+		t.Fatalf("expected 3 IPs, got %v", contents.IPs)
+	}
+	if contents.IPs["10.0.0.1"].ContainerID != "found" {
+		t.Errorf("record of found IP not kept: %v", contents.IPs["10.0.0.1"])
+	}
+	if _, ok := contents.IPs["10.0.0.2"]; ok {
+		t.Errorf("IP missed by the scan not dropped")
+	}
+	if _, ok := contents.IPs["10.0.0.3"]; !ok {
+		t.Errorf("IP within grace dropped")
+	}
+	if _, ok := contents.IPs["10.0.0.4"]; !ok {
+		t.Errorf("IP found by the scan not added")
+	}
+}
+
+func TestInUseIPs_ReconciledConcurrentDel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inuse")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	u := &InUseIPs{path: dir}
+
+	_ = u.Add(net.ParseIP("10.0.0.5"), "container-1")
+
+	// ADDs and DELs go ahead while the namespaces are scanned
+	scan := func() ([]net.IP, int, error) {
+		if err := u.Remove(net.ParseIP("10.0.0.5")); err != nil {
+			t.Fatalf("remove during scan failed %v", err)
+		}
+		if err := u.Add(net.ParseIP("10.0.0.6"), "container-2"); err != nil {
+			t.Fatalf("add during scan failed %v", err)
+		}
+		return []net.IP{net.ParseIP("10.0.0.5")}, 1, nil
+	}
+	ips, err := u.Reconciled(0, time.Minute, scan)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.6")) {
+		t.Fatalf("expected only the IP added during the scan, got %v %v", ips, err)
+	}
+}
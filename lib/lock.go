@@ -1,40 +1,256 @@
 package lib
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"path/filepath"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+)
+
+const (
+	locksDir     = "locks"
+	lockFileExt  = ".lock"
+	lockPollWait = 10 * time.Millisecond
+	lockMaxWait  = 100 * time.Millisecond
+)
+
+// Lock scopes. Scopes are independent, so for example Pods getting IPs on
+// different ENIs don't wait for each other.
+const (
+	// LockRegistry guards the IP registry
+	LockRegistry = "registry"
+	// LockInterfaceAttach guards creating, attaching and removing ENIs
+	LockInterfaceAttach = "interface-attach"
+	// LockEgressIPs guards syncing the egress IPs of namespaces
+	LockEgressIPs = "egress-ips"
+)
+
+// InterfaceLock returns the scope guarding the assignment and release of
+// IPs on an ENI
+func InterfaceLock(interfaceID string) string {
+	return "interface-" + interfaceID
+}
+
+// stateLock returns the scope guarding the state file name
+func stateLock(name string) string {
+	return "state-" + strings.TrimSuffix(name, path.Ext(name))
+}
+
+// LockTimeout bounds how long WithLockTimeout waits for a lock
+var LockTimeout = 2 * time.Minute
+
+// LockHolder describes the process holding a lock
+type LockHolder struct {
+	Scope     string   `json:"scope"`
+	PID       int      `json:"pid"`
+	Command   string   `json:"command"`
+	Container string   `json:"container,omitempty"`
+	HeldSince JSONTime `json:"held_since"`
+}
 
-	"github.com/nightlyone/lockfile"
+// heldLock is a lock held by this process
+type heldLock struct {
+	file  *os.File
+	count int
+}
+
+// heldLocks are the locks held by this process by path. flock(2) locks
+// belong to open files, so a process taking a lock it already holds
+// through another file would wait for itself.
+var (
+	heldLocks     = map[string]*heldLock{}
+	heldLocksLock sync.Mutex
 )
 
-// LockfileRun wraps execution of a specified function around a file lock
-func LockfileRun(run func() error) error {
-	lock, err := lockfile.New(filepath.Join(os.TempDir(), "cni-ipvlan-vpc-k8s.lock"))
+func lockPath(dir, scope string) string {
+	if len(dir) == 0 {
+		dir = StatePath()
+	}
+	return path.Join(dir, locksDir, scope+lockFileExt)
+}
+
+// Lock takes the exclusive lock of scope, shared by all processes using
+// the state directory dir, or the default one if empty. It waits until
+// the deadline of ctx at most, and returns a function releasing the lock.
+// The lock is released by the kernel if the process dies while holding
+// it. A process may take a lock it holds again: re-entrancy is per
+// process, so goroutines of one process share the locks it holds and
+// must serialize among themselves, as Registry does with its mutex.
+func Lock(ctx context.Context, dir, scope string) (func(), error) {
+	lpath := lockPath(dir, scope)
+
+	heldLocksLock.Lock()
+	if held, ok := heldLocks[lpath]; ok {
+		held.count++
+		heldLocksLock.Unlock()
+		return func() { unlock(lpath) }, nil
+	}
+	heldLocksLock.Unlock()
+
+	if err := os.MkdirAll(path.Dir(lpath), os.ModeDir|0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(lpath, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	tries := 1000
 
-	for {
-		tries--
-		if tries <= 0 {
-			return fmt.Errorf("Lockfile not acquired, aborting")
+	for wait := lockPollWait; ; wait *= 2 {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			break
+		}
+		if wait > lockMaxWait {
+			wait = lockMaxWait
 		}
+		select {
+		case <-ctx.Done():
+			holder, _ := readLockHolder(lpath)
+			file.Close()
+			if holder != nil {
+				return nil, fmt.Errorf("lock %v not acquired, held by pid %v (%v) since %v: %v",
+					scope, holder.PID, holder.Command, holder.HeldSince.Format(time.RFC3339), ctx.Err())
+			}
+			return nil, fmt.Errorf("lock %v not acquired: %v", scope, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to lock %v: %v", lpath, err)
+	}
 
-		err = lock.TryLock()
-		if err == nil {
-			break
-		} else if err == lockfile.ErrBusy {
-			time.Sleep(100 * time.Millisecond)
-		} else if err == lockfile.ErrNotExist {
-			time.Sleep(100 * time.Millisecond)
-		} else {
-			return err
+	// Record the holder for diagnostics, which is best effort
+	holder := LockHolder{
+		Scope:     scope,
+		PID:       os.Getpid(),
+		Command:   strings.Join(os.Args, " "),
+		Container: os.Getenv("CNI_CONTAINERID"),
+		HeldSince: JSONTime{Time: time.Now()},
+	}
+	if data, err := json.Marshal(&holder); err == nil {
+		_ = file.Truncate(0)
+		_, _ = file.WriteAt(data, 0)
+	}
+
+	heldLocksLock.Lock()
+	heldLocks[lpath] = &heldLock{file: file, count: 1}
+	heldLocksLock.Unlock()
+	return func() { unlock(lpath) }, nil
+}
+
+func unlock(lpath string) {
+	heldLocksLock.Lock()
+	defer heldLocksLock.Unlock()
+
+	held, ok := heldLocks[lpath]
+	if !ok {
+		return
+	}
+	held.count--
+	if held.count > 0 {
+		return
+	}
+	delete(heldLocks, lpath)
+	_ = held.file.Truncate(0)
+	_ = syscall.Flock(int(held.file.Fd()), syscall.LOCK_UN)
+	held.file.Close()
+}
+
+// WithLock runs fn holding the lock of scope, see Lock
+func WithLock(ctx context.Context, dir, scope string, fn func() error) error {
+	unlock, err := Lock(ctx, dir, scope)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn()
+}
+
+// WithLockTimeout runs fn holding the lock of scope in the default state
+// directory, waiting up to LockTimeout for it
+func WithLockTimeout(scope string, fn func() error) error {
+	return withLockTimeout("", scope, fn)
+}
+
+func withLockTimeout(dir, scope string, fn func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), LockTimeout)
+	defer cancel()
+	return WithLock(ctx, dir, scope, fn)
+}
+
+// readLockHolder returns the holder recorded in a lock file, if any
+func readLockHolder(lpath string) (*LockHolder, error) {
+	data, err := ioutil.ReadFile(lpath)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	holder := &LockHolder{}
+	if err := json.Unmarshal(data, holder); err != nil {
+		return nil, err
+	}
+	return holder, nil
+}
+
+// LockHolders returns the holders of the locks currently held in the state
+// directory dir, or the default one if empty, sorted by scope
+func LockHolders(dir string) ([]*LockHolder, error) {
+	lpaths, err := ioutil.ReadDir(path.Dir(lockPath(dir, "")))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	holders := []*LockHolder{}
+	for _, info := range lpaths {
+		if !strings.HasSuffix(info.Name(), lockFileExt) {
+			continue
+		}
+		scope := strings.TrimSuffix(info.Name(), lockFileExt)
+		held, err := lockHeld(lockPath(dir, scope))
+		if err != nil || !held {
+			continue
 		}
+		holder, err := readLockHolder(lockPath(dir, scope))
+		if err != nil || holder == nil {
+			// Held, but the holder was not recorded yet
+			holder = &LockHolder{Scope: scope}
+		}
+		holders = append(holders, holder)
+	}
+	sort.Slice(holders, func(i, j int) bool { return holders[i].Scope < holders[j].Scope })
+	return holders, nil
+}
+
+// lockHeld returns whether a lock file is locked, by this or another
+// process
+func lockHeld(lpath string) (bool, error) {
+	heldLocksLock.Lock()
+	_, ok := heldLocks[lpath]
+	heldLocksLock.Unlock()
+	if ok {
+		return true, nil
 	}
 
-	defer func() { _ = lock.Unlock() }()
-	return run()
+	file, err := os.Open(lpath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	return false, nil
 }
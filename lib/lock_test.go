@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	unlock, err := Lock(context.Background(), dir, LockRegistry)
+	if err != nil {
+		t.Fatalf("lock failed %v", err)
+	}
+
+	// Taking a held lock again does not wait
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	unlockAgain, err := Lock(ctx, dir, LockRegistry)
+	if err != nil {
+		t.Fatalf("reentrant lock failed %v", err)
+	}
+	unlockAgain()
+
+	holders, err := LockHolders(dir)
+	if err != nil || len(holders) != 1 || holders[0].Scope != LockRegistry || holders[0].PID != os.Getpid() {
+		t.Fatalf("expected this process to hold the registry lock, got %v %v", holders, err)
+	}
+
+	unlock()
+	holders, err = LockHolders(dir)
+	if err != nil || len(holders) != 0 {
+		t.Fatalf("expected no held locks, got %v %v", holders, err)
+	}
+}
+
+func TestLock_Timeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	scope := InterfaceLock("eni-1")
+	unlock, err := Lock(context.Background(), dir, scope)
+	if err != nil {
+		t.Fatalf("lock failed %v", err)
+	}
+
+	// Hold the lock through another file, as another process would
+	other, err := os.Open(lockPath(dir, scope))
+	if err != nil {
+		t.Fatalf("unable to open lock file %v", err)
+	}
+	defer other.Close()
+	unlock()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatalf("unable to flock %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = Lock(ctx, dir, scope)
+	if err == nil || !strings.Contains(err.Error(), scope) {
+		t.Fatalf("expected a timeout naming the lock, got %v", err)
+	}
+
+	// Independent scopes don't wait for each other
+	if err := WithLock(context.Background(), dir, InterfaceLock("eni-2"), func() error { return nil }); err != nil {
+		t.Fatalf("lock of another scope failed %v", err)
+	}
+}
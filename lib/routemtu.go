@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+)
+
+// MTUs AWS supports by the path traffic takes, see
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/network_mtu.html
+const (
+	// ExternalMTU applies to traffic leaving the VPC through NAT, an
+	// Internet gateway or an inter-region peering
+	ExternalMTU = 1500
+	// IntraRegionPeerMTU applies to VPC peerings within a region
+	IntraRegionPeerMTU = 9001
+	// TransitGatewayMTU applies to traffic through a transit gateway
+	TransitGatewayMTU = 8500
+)
+
+// RoutePaths classifies route destinations by the path their traffic
+// takes out of the VPC
+type RoutePaths struct {
+	// VPC are the CIDRs of the VPC
+	VPC []*net.IPNet
+	// Peer are the CIDRs of peered VPCs, in any region
+	Peer []*net.IPNet
+	// InterRegionPeer are the CIDRs of peered VPCs in other regions
+	InterRegionPeer []*net.IPNet
+	// TransitGateway are the CIDRs routed to transit gateways
+	TransitGateway []*net.IPNet
+}
+
+// RouteMTUs selects the MTU of a route by the path its traffic takes. A
+// zero MTU leaves the route at the MTU of its interface.
+type RouteMTUs struct {
+	// VPC applies to routes within the VPC CIDRs
+	VPC int
+	// Peer applies to routes to peered VPCs, and to the other routes
+	// below whose MTU is not set
+	Peer int
+	// InterRegionPeer applies to routes to peered VPCs in other regions
+	InterRegionPeer int
+	// TransitGateway applies to routes to transit gateways
+	TransitGateway int
+	// External applies to the remaining routes, e.g. routeToCidrs
+	// destinations reached through NAT
+	External int
+	// Default applies to the default route
+	Default int
+	// CIDRs overrides the MTU of routes to specific destinations
+	CIDRs map[string]int
+}
+
+// Detect fills in the MTUs not configured with those AWS supports for
+// each path out of the VPC
+func (m *RouteMTUs) Detect() {
+	detected := []struct {
+		mtu   *int
+		value int
+	}{
+		{&m.Peer, IntraRegionPeerMTU},
+		{&m.InterRegionPeer, ExternalMTU},
+		{&m.TransitGateway, TransitGatewayMTU},
+		{&m.External, ExternalMTU},
+		{&m.Default, ExternalMTU},
+	}
+	for _, d := range detected {
+		if *d.mtu == 0 {
+			*d.mtu = d.value
+		}
+	}
+}
+
+// Validate checks all MTUs are in the range an ENI supports
+func (m *RouteMTUs) Validate() error {
+	mtus := []int{m.VPC, m.Peer, m.InterRegionPeer, m.TransitGateway, m.External, m.Default}
+	for cidr, mtu := range m.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid route MTU destination %q", cidr)
+		}
+		mtus = append(mtus, mtu)
+	}
+	for _, mtu := range mtus {
+		if mtu != 0 && (mtu < 576 || mtu > 9001) {
+			return fmt.Errorf("invalid route MTU %d", mtu)
+		}
+	}
+	return nil
+}
+
+// NeedsRoutePaths returns whether routes must be classified by path to
+// select their MTU
+func (m *RouteMTUs) NeedsRoutePaths() bool {
+	return m.VPC != 0 || m.Peer != 0 || m.InterRegionPeer != 0 || m.TransitGateway != 0 || m.External != 0
+}
+
+// NeedsPeers returns whether routes to peered VPCs may get another MTU
+// than external routes
+func (m *RouteMTUs) NeedsPeers() bool {
+	external := orMTU(m.External, m.Peer)
+	return m.Peer != external || orMTU(m.InterRegionPeer, m.Peer) != external
+}
+
+// NeedsTransitGateways returns whether routes to transit gateways get
+// another MTU than external routes
+func (m *RouteMTUs) NeedsTransitGateways() bool {
+	return orMTU(m.TransitGateway, m.Peer) != orMTU(m.External, m.Peer)
+}
+
+// For returns the MTU of a route to dst, given the classified paths
+func (m *RouteMTUs) For(dst net.IPNet, paths *RoutePaths) int {
+	if mtu, ok := m.CIDRs[dst.String()]; ok {
+		return mtu
+	}
+	if ones, _ := dst.Mask.Size(); ones == 0 {
+		return m.Default
+	}
+	if paths == nil {
+		paths = &RoutePaths{}
+	}
+	switch {
+	case within(dst, paths.VPC):
+		return m.VPC
+	case within(dst, paths.InterRegionPeer):
+		return orMTU(m.InterRegionPeer, m.Peer)
+	case within(dst, paths.Peer):
+		return m.Peer
+	case within(dst, paths.TransitGateway):
+		return orMTU(m.TransitGateway, m.Peer)
+	}
+	return orMTU(m.External, m.Peer)
+}
+
+// within returns whether dst is one of cidrs or a subnet of one
+func within(dst net.IPNet, cidrs []*net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	for _, cidr := range cidrs {
+		cidrOnes, _ := cidr.Mask.Size()
+		if cidr.Contains(dst.IP) && ones >= cidrOnes {
+			return true
+		}
+	}
+	return false
+}
+
+// orMTU returns mtu, or fallback if it is not set
+func orMTU(mtu, fallback int) int {
+	if mtu != 0 {
+		return mtu
+	}
+	return fallback
+}
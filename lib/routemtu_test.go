@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRouteMTUsFor(t *testing.T) {
+	parse := func(cidrs ...string) (nets []*net.IPNet) {
+		for _, cidr := range cidrs {
+			_, n, _ := net.ParseCIDR(cidr)
+			nets = append(nets, n)
+		}
+		return
+	}
+	paths := &RoutePaths{
+		VPC:             parse("10.0.0.0/16"),
+		Peer:            parse("10.1.0.0/16", "10.2.0.0/16"),
+		InterRegionPeer: parse("10.2.0.0/16"),
+		TransitGateway:  parse("10.100.0.0/14"),
+	}
+
+	mtus := RouteMTUs{
+		VPC:   9001,
+		CIDRs: map[string]int{"192.168.0.0/16": 1400},
+	}
+	mtus.Detect()
+
+	cases := map[string]int{
+		"0.0.0.0/0":      1500,
+		"10.0.0.0/16":    9001,
+		"10.0.128.0/17":  9001,
+		"10.1.0.0/16":    9001,
+		"10.2.0.0/16":    1500,
+		"10.101.0.0/16":  8500,
+		"10.0.0.0/8":     1500,
+		"172.16.0.0/12":  1500,
+		"192.168.0.0/16": 1400,
+	}
+	for cidr, expected := range cases {
+		_, dst, _ := net.ParseCIDR(cidr)
+		if mtu := mtus.For(*dst, paths); mtu != expected {
+			t.Errorf("Expected MTU %d for %v, got %d", expected, cidr, mtu)
+		}
+	}
+
+	// Without specific MTUs, all routes out of the VPC use the peer MTU
+	peerOnly := RouteMTUs{Peer: 1500}
+	if peerOnly.NeedsPeers() || peerOnly.NeedsTransitGateways() {
+		t.Errorf("Peer MTU alone needs no peer or transit gateway lookups")
+	}
+	for _, cidr := range []string{"10.1.0.0/16", "10.2.0.0/16", "10.101.0.0/16", "172.16.0.0/12"} {
+		_, dst, _ := net.ParseCIDR(cidr)
+		if mtu := peerOnly.For(*dst, paths); mtu != 1500 {
+			t.Errorf("Expected peer MTU for %v, got %d", cidr, mtu)
+		}
+	}
+	if !mtus.NeedsPeers() || !mtus.NeedsTransitGateways() {
+		t.Errorf("Detected MTUs need peer and transit gateway lookups")
+	}
+}
+
+func TestRouteMTUsValidate(t *testing.T) {
+	valid := RouteMTUs{VPC: 9001, Peer: 1500}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Valid MTUs rejected: %v", err)
+	}
+
+	invalid := []RouteMTUs{
+		{Default: 65535},
+		{CIDRs: map[string]int{"10.0.0.0": 1500}},
+		{CIDRs: map[string]int{"10.0.0.0/8": 100}},
+	}
+	for _, mtus := range invalid {
+		if err := mtus.Validate(); err == nil {
+			t.Errorf("Invalid MTUs accepted %+v", mtus)
+		}
+	}
+}
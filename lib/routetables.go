@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	routeTablesFile          = "route-tables.json"
+	routeTablesSchemaVersion = 1
+	maxRouteTable            = 0xfffffffe // tables above this value are reserved
+)
+
+// ReservedRouteTable returns whether table is one of the unspecified,
+// default, main and local tables of the kernel, which are never handed
+// out nor flushed
+func ReservedRouteTable(table int) bool {
+	return table == 0 || (table >= 253 && table <= 255)
+}
+
+type routeTablesContents struct {
+	SchemaVersion int            `json:"schema_version"`
+	Tables        map[string]int `json:"tables"`
+	// AllocatedOn is when each container last allocated its table
+	AllocatedOn map[string]JSONTime `json:"allocated_on,omitempty"`
+}
+
+// RouteTables allocates policy routing tables to containers and persists
+// the assignment alongside the IP registry. Allocation is serialized
+// across processes with a file lock, and always hands out the lowest
+// table not already assigned, so no probing or retries are needed.
+type RouteTables struct {
+	path string
+}
+
+// locked runs fn with exclusive access to the persisted table assignments,
+// saving them afterwards if write is set and fn returns successfully
+func (r *RouteTables) locked(write bool, fn func(contents *routeTablesContents) error) error {
+	contents := routeTablesContents{}
+	return lockedStateFile(r.path, routeTablesFile, write, &contents, func() error {
+		if contents.Tables == nil {
+			contents.Tables = map[string]int{}
+		}
+		if contents.AllocatedOn == nil {
+			contents.AllocatedOn = map[string]JSONTime{}
+		}
+		contents.SchemaVersion = routeTablesSchemaVersion
+		return fn(&contents)
+	})
+}
+
+// Allocate returns the table assigned to containerID, assigning the lowest
+// table at or above start if there is none yet. Tables in taken are in use
+// outside of this allocator (for example by rules created before it
+// existed) and are never handed out, nor are reserved tables.
+func (r *RouteTables) Allocate(containerID string, start int, taken map[int]bool) (table int, err error) {
+	err = r.locked(true, func(contents *routeTablesContents) error {
+		contents.AllocatedOn[containerID] = JSONTime{Time: time.Now()}
+		if existing, ok := contents.Tables[containerID]; ok {
+			table = existing
+			return nil
+		}
+
+		assigned := make(map[int]bool, len(contents.Tables))
+		for _, t := range contents.Tables {
+			assigned[t] = true
+		}
+		for t := start; t <= maxRouteTable; t++ {
+			if !assigned[t] && !taken[t] && !ReservedRouteTable(t) {
+				contents.Tables[containerID] = t
+				table = t
+				return nil
+			}
+		}
+		delete(contents.AllocatedOn, containerID)
+		return fmt.Errorf("failed to find free route table")
+	})
+	return
+}
+
+// Lookup returns the table assigned to containerID, if any
+func (r *RouteTables) Lookup(containerID string) (table int, found bool, err error) {
+	err = r.locked(false, func(contents *routeTablesContents) error {
+		table, found = contents.Tables[containerID]
+		return nil
+	})
+	return
+}
+
+// Release removes the table assignment of containerID
+func (r *RouteTables) Release(containerID string) error {
+	return r.locked(true, func(contents *routeTablesContents) error {
+		delete(contents.Tables, containerID)
+		delete(contents.AllocatedOn, containerID)
+		return nil
+	})
+}
+
+// ReleaseTable removes any assignment of the given table
+func (r *RouteTables) ReleaseTable(table int) error {
+	return r.locked(true, func(contents *routeTablesContents) error {
+		for containerID, t := range contents.Tables {
+			if t == table {
+				delete(contents.Tables, containerID)
+				delete(contents.AllocatedOn, containerID)
+			}
+		}
+		return nil
+	})
+}
+
+// ReleaseUnused removes the assignments of tables not in inUse, typically
+// the tables selected by IP rules, which were allocated before t. This
+// reclaims the tables of ADDs which failed or were lost before their
+// rules were created, or whose rules are gone. Assignments recorded
+// without an allocation time count as old. It returns the released
+// assignments.
+func (r *RouteTables) ReleaseUnused(inUse map[int]bool, t time.Time) (released []RouteTable, err error) {
+	err = r.locked(true, func(contents *routeTablesContents) error {
+		for containerID, table := range contents.Tables {
+			if inUse[table] || contents.AllocatedOn[containerID].After(t) {
+				continue
+			}
+			delete(contents.Tables, containerID)
+			delete(contents.AllocatedOn, containerID)
+			released = append(released, RouteTable{ContainerID: containerID, Table: table})
+		}
+		return nil
+	})
+	sort.Slice(released, func(i, j int) bool { return released[i].Table < released[j].Table })
+	return
+}
+
+// List returns all assigned tables, sorted by table
+func (r *RouteTables) List() (ret []RouteTable, err error) {
+	err = r.locked(false, func(contents *routeTablesContents) error {
+		for containerID, t := range contents.Tables {
+			ret = append(ret, RouteTable{ContainerID: containerID, Table: t})
+		}
+		return nil
+	})
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Table < ret[j].Table })
+	return
+}
+
+// RouteTable is a single container to table assignment
+type RouteTable struct {
+	ContainerID string
+	Table       int
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRouteTables(t *testing.T) (*RouteTables, func()) {
+	dir, err := ioutil.TempDir("", "routetables")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	return &RouteTables{path: dir}, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestRouteTables_Allocate(t *testing.T) {
+	r, cleanup := newTestRouteTables(t)
+	defer cleanup()
+
+	first, err := r.Allocate("container-1", 256, nil)
+	if err != nil || first != 256 {
+		t.Fatalf("expected table 256, got %v %v", first, err)
+	}
+
+	// Allocation is idempotent per container
+	again, err := r.Allocate("container-1", 256, nil)
+	if err != nil || again != first {
+		t.Fatalf("expected table %v on re-allocation, got %v %v", first, again, err)
+	}
+
+	// Tables in use elsewhere are skipped
+	second, err := r.Allocate("container-2", 256, map[int]bool{257: true})
+	if err != nil || second != 258 {
+		t.Fatalf("expected table 258, got %v %v", second, err)
+	}
+
+	// Released tables are handed out again, lowest first
+	if err := r.Release("container-1"); err != nil {
+		t.Fatalf("release failed %v", err)
+	}
+	if _, found, _ := r.Lookup("container-1"); found {
+		t.Fatalf("released container still has a table")
+	}
+	third, err := r.Allocate("container-3", 256, nil)
+	if err != nil || third != 256 {
+		t.Fatalf("expected released table 256, got %v %v", third, err)
+	}
+}
+
+func TestRouteTables_AllocateReserved(t *testing.T) {
+	r, cleanup := newTestRouteTables(t)
+	defer cleanup()
+
+	// A low routeTableStart skips the default, main and local tables
+	var allocated []int
+	for i := 0; i < 3; i++ {
+		table, err := r.Allocate(fmt.Sprintf("container-%d", i), 252, nil)
+		if err != nil {
+			t.Fatalf("allocate failed %v", err)
+		}
+		allocated = append(allocated, table)
+	}
+	if allocated[0] != 252 || allocated[1] != 256 || allocated[2] != 257 {
+		t.Fatalf("expected tables 252, 256 and 257, got %v", allocated)
+	}
+}
+
+func TestRouteTables_ReleaseTable(t *testing.T) {
+	r, cleanup := newTestRouteTables(t)
+	defer cleanup()
+
+	table, _ := r.Allocate("container-1", 256, nil)
+	if err := r.ReleaseTable(table); err != nil {
+		t.Fatalf("release table failed %v", err)
+	}
+
+	tables, err := r.List()
+	if err != nil || len(tables) != 0 {
+		t.Fatalf("expected no tables, got %v %v", tables, err)
+	}
+}
+
+func TestRouteTables_AllocateConcurrent(t *testing.T) {
+	r, cleanup := newTestRouteTables(t)
+	defer cleanup()
+
+	const workers = 20
+	var wg sync.WaitGroup
+	results := make([]int, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = (&RouteTables{path: r.path}).Allocate(string(rune('a'+i)), 256, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[int]bool{}
+	for _, table := range results {
+		if seen[table] {
+			t.Fatalf("table %v allocated twice: %v", table, results)
+		}
+		seen[table] = true
+	}
+}
+
+func TestRouteTables_ReleaseUnused(t *testing.T) {
+	r, cleanup := newTestRouteTables(t)
+	defer cleanup()
+
+	ruled, _ := r.Allocate("container-1", 256, nil)
+	unruled, _ := r.Allocate("container-2", 256, nil)
+
+	// Tables allocated after the cutoff are kept, as their ADD may still
+	// be creating rules
+	released, err := r.ReleaseUnused(map[int]bool{ruled: true}, time.Now().Add(-time.Minute))
+	if err != nil || len(released) != 0 {
+		t.Fatalf("expected no released tables, got %v %v", released, err)
+	}
+
+	released, err = r.ReleaseUnused(map[int]bool{ruled: true}, time.Now().Add(time.Minute))
+	if err != nil || len(released) != 1 || released[0].Table != unruled || released[0].ContainerID != "container-2" {
+		t.Fatalf("expected table %v released, got %v %v", unruled, released, err)
+	}
+	if _, found, _ := r.Lookup("container-1"); !found {
+		t.Fatalf("table with rules released")
+	}
+}
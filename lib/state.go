@@ -0,0 +1,261 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	stateDir   = "cni-ipvlan-vpc-k8s"
+	bootIDFile = "boot-id"
+)
+
+// bootIDPath is where the kernel exposes the random ID of the current boot
+var bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// stateFileLocks serialize the goroutines of this process accessing a
+// state file by path, as Lock is reentrant within a process
+var (
+	stateFileLocks     = map[string]*sync.Mutex{}
+	stateFileLocksLock sync.Mutex
+)
+
+// rootStatePath is the default state directory of root
+var rootStatePath = path.Join("/var/lib", stateDir)
+
+// legacyStatePath is where root kept state before it moved to a directory
+// surviving reboots
+var legacyStatePath = path.Join("/run", stateDir)
+
+// legacyStateFiles are the state files moved out of legacyStatePath. The
+// registry file is written by aws.Registry.
+var legacyStateFiles = []string{"registry.json", routeTablesFile, egressIPsFile, inUseIPsFile}
+
+// importedLegacyState are the state directories legacy state was moved
+// into by this process
+var (
+	importedLegacyState     = map[string]bool{}
+	importedLegacyStateLock sync.Mutex
+)
+
+// statePath overrides the default state location when set
+var statePath string
+
+// SetStatePath sets the location of persisted plugin state, or restores
+// the default one if dir is empty
+func SetStatePath(dir string) {
+	statePath = dir
+}
+
+// StatePath gives the location for persisted plugin state. It defaults
+// to a directory which survives reboots, or one which varies based on
+// invoking user ID for non-root users.
+func StatePath() string {
+	if len(statePath) != 0 {
+		return statePath
+	}
+	uid := os.Getuid()
+	if uid != 0 {
+		// Non-root users of the state directory
+		return path.Join("/run/user", fmt.Sprintf("%d", uid), stateDir)
+	}
+
+	return rootStatePath
+}
+
+// EnsureStatePath returns the state directory dir, or the default one if
+// empty, creating it if needed. On the first use of rootStatePath, state
+// files an older version left in legacyStatePath are moved into it, so
+// upgrades keep the release times of free IPs and the assignments of
+// egress IPs and route tables.
+func EnsureStatePath(dir string) (string, error) {
+	if len(dir) == 0 {
+		dir = StatePath()
+	}
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		err = os.MkdirAll(dir, os.ModeDir|0700)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	importedLegacyStateLock.Lock()
+	defer importedLegacyStateLock.Unlock()
+	if importedLegacyState[dir] || path.Clean(dir) != rootStatePath {
+		return dir, nil
+	}
+	// Every process imports before its first access to the state, so
+	// files are only imported before being written in dir
+	err = withLockTimeout(dir, stateLock("legacy-import"), func() error {
+		return importLegacyState(dir)
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to import state from %v: %v", legacyStatePath, err)
+	}
+	importedLegacyState[dir] = true
+	return dir, nil
+}
+
+// importLegacyState moves the legacy state files missing in dir into it
+func importLegacyState(dir string) error {
+	for _, name := range legacyStateFiles {
+		legacy := path.Join(legacyStatePath, name)
+		data, err := ioutil.ReadFile(legacy)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		fpath := path.Join(dir, name)
+		if _, err := os.Stat(fpath); os.IsNotExist(err) {
+			if err := WriteFileAtomic(fpath, data, 0600); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		if err := os.Remove(legacy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withStateFileLock runs fn holding the lock of the state file name in
+// dir, against other processes and other goroutines of this one
+func withStateFileLock(dir, name string, fn func() error) error {
+	fpath := path.Join(dir, name)
+	stateFileLocksLock.Lock()
+	mu, ok := stateFileLocks[fpath]
+	if !ok {
+		mu = &sync.Mutex{}
+		stateFileLocks[fpath] = mu
+	}
+	stateFileLocksLock.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return withLockTimeout(dir, stateLock(name), fn)
+}
+
+// BootTime returns when the host booted
+func BootTime() (time.Time, error) {
+	info := syscall.Sysinfo_t{}
+	if err := syscall.Sysinfo(&info); err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(-time.Duration(info.Uptime) * time.Second), nil
+}
+
+// OncePerBoot runs fn unless it already succeeded since the host booted,
+// as recorded in the state directory dir, or the default one if empty.
+// Concurrent callers wait for fn to finish.
+func OncePerBoot(dir string, fn func() error) error {
+	dir, err := EnsureStatePath(dir)
+	if err != nil {
+		return err
+	}
+	fpath := path.Join(dir, bootIDFile)
+
+	bootID, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return err
+	}
+
+	return withStateFileLock(dir, bootIDFile, func() error {
+		recorded, err := ioutil.ReadFile(fpath)
+		if err == nil && bytes.Equal(recorded, bootID) {
+			return nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := fn(); err != nil {
+			return err
+		}
+		return WriteFileAtomic(fpath, bootID, 0600)
+	})
+}
+
+// lockedStateFile runs fn with exclusive access to the JSON state file
+// name within dir, decoded into contents. contents is saved afterwards if
+// write is set and fn returns successfully.
+func lockedStateFile(dir, name string, write bool, contents interface{}, fn func() error) error {
+	dir, err := EnsureStatePath(dir)
+	if err != nil {
+		return err
+	}
+	fpath := path.Join(dir, name)
+
+	return withStateFileLock(dir, name, func() error {
+		file, err := os.Open(fpath)
+		if err == nil {
+			err = json.NewDecoder(file).Decode(contents)
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("invalid state in %v: %v", fpath, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := fn(); err != nil || !write {
+			return err
+		}
+
+		data, err := json.Marshal(contents)
+		if err != nil {
+			return err
+		}
+		return WriteFileAtomic(fpath, append(data, '\n'), 0600)
+	})
+}
+
+// WriteFileAtomic replaces the file at fpath with data, so readers and a
+// crash at any point see either the old or the new contents. data is
+// synced to a temporary file in the same directory before it is renamed
+// over fpath.
+func WriteFileAtomic(fpath string, data []byte, perm os.FileMode) error {
+	dir, name := path.Split(fpath)
+	if len(dir) == 0 {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fpath); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := path.Join(dir, "state.json")
+
+	for _, data := range []string{"first\n", "second\n"} {
+		if err := WriteFileAtomic(fpath, []byte(data), 0600); err != nil {
+			t.Fatalf("write failed %v", err)
+		}
+		read, err := ioutil.ReadFile(fpath)
+		if err != nil || string(read) != data {
+			t.Fatalf("expected %q, got %q %v", data, read, err)
+		}
+	}
+
+	// No temporary files are left behind
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected only the state file, got %v", files)
+	}
+	if files[0].Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", files[0].Mode())
+	}
+}
+
+func TestOncePerBoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(orig string) { bootIDPath = orig }(bootIDPath)
+	bootIDPath = path.Join(dir, "boot_id")
+	_ = ioutil.WriteFile(bootIDPath, []byte("boot-1\n"), 0600)
+
+	runs := 0
+	run := func() error {
+		runs++
+		return nil
+	}
+	_ = OncePerBoot(dir, func() error { return fmt.Errorf("failed") })
+	for i := 0; i < 2; i++ {
+		if err := OncePerBoot(dir, run); err != nil {
+			t.Fatalf("once per boot failed %v", err)
+		}
+	}
+	if runs != 1 {
+		t.Fatalf("expected 1 run after a failure, got %v", runs)
+	}
+
+	_ = ioutil.WriteFile(bootIDPath, []byte("boot-2\n"), 0600)
+	if err := OncePerBoot(dir, run); err != nil || runs != 2 {
+		t.Fatalf("expected a run after a reboot, got %v %v", runs, err)
+	}
+}
+
+func TestStatePath(t *testing.T) {
+	defer SetStatePath("")
+	SetStatePath("/tmp/state")
+	if StatePath() != "/tmp/state" {
+		t.Fatalf("state path not set, got %v", StatePath())
+	}
+	SetStatePath("")
+	if os.Getuid() == 0 && StatePath() != "/var/lib/cni-ipvlan-vpc-k8s" {
+		t.Fatalf("unexpected default state path %v", StatePath())
+	}
+}
+
+func TestEnsureStatePath_ImportsLegacyState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(orig string) { legacyStatePath = orig }(legacyStatePath)
+	legacyStatePath = path.Join(dir, "run")
+	_ = os.MkdirAll(legacyStatePath, 0700)
+	_ = ioutil.WriteFile(path.Join(legacyStatePath, "registry.json"), []byte("legacy\n"), 0600)
+	_ = ioutil.WriteFile(path.Join(legacyStatePath, routeTablesFile), []byte("legacy\n"), 0600)
+
+	// Files already in the state directory are kept
+	defer func(orig string) { rootStatePath = orig }(rootStatePath)
+	rootStatePath = path.Join(dir, "lib")
+	stateDir := rootStatePath
+	_ = os.MkdirAll(stateDir, 0700)
+	_ = ioutil.WriteFile(path.Join(stateDir, routeTablesFile), []byte("current\n"), 0600)
+
+	for i := 0; i < 2; i++ {
+		if got, err := EnsureStatePath(stateDir); err != nil || got != stateDir {
+			t.Fatalf("ensure state path failed %v %v", got, err)
+		}
+	}
+	// Other state directories don't import it
+	other := path.Join(dir, "other")
+	if _, err := EnsureStatePath(other); err != nil {
+		t.Fatalf("ensure state path failed %v", err)
+	}
+	if _, err := os.Stat(path.Join(other, "registry.json")); !os.IsNotExist(err) {
+		t.Errorf("expected no import into %v, got %v", other, err)
+	}
+
+	for name, expected := range map[string]string{"registry.json": "legacy\n", routeTablesFile: "current\n"} {
+		data, err := ioutil.ReadFile(path.Join(stateDir, name))
+		if err != nil || string(data) != expected {
+			t.Errorf("expected %v to be %q, got %q %v", name, expected, data, err)
+		}
+		if _, err := os.Stat(path.Join(legacyStatePath, name)); !os.IsNotExist(err) {
+			t.Errorf("expected legacy %v to be removed, got %v", name, err)
+		}
+	}
+}
+
+func TestLockedStateFile_Timeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("unable to create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(orig time.Duration) { LockTimeout = orig }(LockTimeout)
+	LockTimeout = 50 * time.Millisecond
+
+	// Hold the lock of the state file, as a wedged process would
+	lpath := lockPath(dir, stateLock(inUseIPsFile))
+	_ = os.MkdirAll(path.Dir(lpath), 0700)
+	other, err := os.OpenFile(lpath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("unable to open lock file %v", err)
+	}
+	defer other.Close()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatalf("unable to flock %v", err)
+	}
+
+	err = (&InUseIPs{path: dir}).Remove(nil)
+	if err == nil || !strings.Contains(err.Error(), stateLock(inUseIPsFile)) {
+		t.Fatalf("expected a timeout naming the lock, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package nl
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ipConntrackFilter matches the conntrack flows with an IP as source or
+// destination, in either direction
+type ipConntrackFilter struct {
+	ip net.IP
+}
+
+func (f *ipConntrackFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	return f.ip.Equal(flow.Forward.SrcIP) || f.ip.Equal(flow.Forward.DstIP) ||
+		f.ip.Equal(flow.Reverse.SrcIP) || f.ip.Equal(flow.Reverse.DstIP)
+}
+
+// FlushConntrack deletes the conntrack entries of the current namespace
+// involving ip, such as NodePort or masquerade entries of a released Pod
+// IP, so they can't misroute traffic to the next Pod using it
+func FlushConntrack(ip net.IP) (uint, error) {
+	family := netlink.InetFamily(unix.AF_INET)
+	if ip.To4() == nil {
+		family = netlink.InetFamily(unix.AF_INET6)
+	}
+	return netlink.ConntrackDeleteFilter(netlink.ConntrackTable, family, &ipConntrackFilter{ip: ip})
+}
+
+// FlushNeighbors deletes the neighbor entries for ip on the veth links of
+// the current namespace, e.g. those learned from the Pod which used it
+// before
+func FlushNeighbors(ip net.IP) error {
+	family := netlink.FAMILY_V4
+	if ip.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if link.Type() != "veth" {
+			continue
+		}
+		neighs, err := netlink.NeighList(link.Attrs().Index, family)
+		if err != nil {
+			return err
+		}
+		for i := range neighs {
+			if !neighs[i].IP.Equal(ip) {
+				continue
+			}
+			if err := netlink.NeighDel(&neighs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
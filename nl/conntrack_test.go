@@ -0,0 +1,74 @@
+package nl
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestIPConntrackFilter(t *testing.T) {
+	ip := net.ParseIP("10.0.0.5")
+	filter := &ipConntrackFilter{ip: ip}
+
+	flow := &netlink.ConntrackFlow{}
+	flow.Forward.SrcIP = net.ParseIP("10.0.0.9")
+	flow.Forward.DstIP = net.ParseIP("10.0.0.1")
+	flow.Reverse.SrcIP = net.ParseIP("10.0.0.1")
+	flow.Reverse.DstIP = net.ParseIP("10.0.0.9")
+	if filter.MatchConntrackFlow(flow) {
+		t.Errorf("Unrelated flow matched")
+	}
+
+	// A NodePort connection DNATed to the Pod IP
+	flow.Reverse.SrcIP = ip
+	if !filter.MatchConntrackFlow(flow) {
+		t.Errorf("Flow replied by the IP not matched")
+	}
+}
+
+func TestFlushNeighbors(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: "lyftveth0"},
+		PeerName:  "lyftveth1",
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("veth links not supported: %v", err)
+	}
+	defer func() { _ = netlink.LinkDel(veth) }()
+
+	ip := net.ParseIP("10.0.0.5")
+	hwAddr, _ := net.ParseMAC("02:00:00:00:00:05")
+	link, err := netlink.LinkByName("lyftveth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = netlink.NeighAdd(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		State:        netlink.NUD_PERMANENT,
+		IP:           ip,
+		HardwareAddr: hwAddr,
+	})
+	if err != nil {
+		t.Fatalf("Failed to add neighbor: %v", err)
+	}
+
+	if err := FlushNeighbors(ip); err != nil {
+		t.Fatalf("Failed to flush neighbors: %v", err)
+	}
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, neigh := range neighs {
+		if neigh.IP.Equal(ip) {
+			t.Errorf("Neighbor %v not flushed", neigh)
+		}
+	}
+}
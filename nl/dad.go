@@ -0,0 +1,148 @@
+package nl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	arpFrameSize    = 42
+	arpHdrOffset    = 14
+	arpOpRequest    = 1
+	arpHTypeEther   = 1
+	ethAddrLen      = 6
+	ipv4AddrLen     = 4
+	arpSenderHwAddr = arpHdrOffset + 8
+	arpSenderIP     = arpHdrOffset + 14
+	arpTargetIP     = arpHdrOffset + 24
+)
+
+func htons(i uint16) uint16 {
+	return i<<8 | i>>8
+}
+
+// arpProbeFrame builds an ARP probe (RFC 5227 2.1.1) for ip from hwAddr:
+// a broadcast request with an all-zero sender IP, so the neighbors of
+// the prober don't update their caches
+func arpProbeFrame(hwAddr net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, arpFrameSize)
+	for i := 0; i < ethAddrLen; i++ {
+		frame[i] = 0xff
+	}
+	copy(frame[ethAddrLen:], hwAddr)
+	binary.BigEndian.PutUint16(frame[12:], unix.ETH_P_ARP)
+
+	binary.BigEndian.PutUint16(frame[arpHdrOffset:], arpHTypeEther)
+	binary.BigEndian.PutUint16(frame[arpHdrOffset+2:], unix.ETH_P_IP)
+	frame[arpHdrOffset+4] = ethAddrLen
+	frame[arpHdrOffset+5] = ipv4AddrLen
+	binary.BigEndian.PutUint16(frame[arpHdrOffset+6:], arpOpRequest)
+	copy(frame[arpSenderHwAddr:], hwAddr)
+	copy(frame[arpTargetIP:], ip.To4())
+	return frame
+}
+
+// arpConflict returns the hardware address of the sender of an ARP frame
+// if it claims ip, or probes for it as well, and isn't hwAddr
+func arpConflict(frame []byte, hwAddr net.HardwareAddr, ip net.IP) net.HardwareAddr {
+	if len(frame) < arpFrameSize || binary.BigEndian.Uint16(frame[12:]) != unix.ETH_P_ARP {
+		return nil
+	}
+	sender := net.HardwareAddr(frame[arpSenderHwAddr : arpSenderHwAddr+ethAddrLen])
+	if bytes.Equal(sender, hwAddr) {
+		return nil
+	}
+	senderIP := net.IP(frame[arpSenderIP : arpSenderIP+ipv4AddrLen])
+	targetIP := net.IP(frame[arpTargetIP : arpTargetIP+ipv4AddrLen])
+	probe := senderIP.Equal(net.IPv4zero) && targetIP.Equal(ip)
+	if !senderIP.Equal(ip) && !probe {
+		return nil
+	}
+	return append(net.HardwareAddr(nil), sender...)
+}
+
+// ArpProbe probes over ifName whether another host uses ip, and returns
+// its hardware address if one answers within timeout. Pods sharing the
+// hardware address of ifName through ipvlan are not detected.
+func ArpProbe(ifName string, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("not an IPv4 address: %v", ip)
+	}
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	addr := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  iface.Index,
+		Halen:    ethAddrLen,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		return nil, err
+	}
+	for i := 0; i < ethAddrLen; i++ {
+		addr.Addr[i] = 0xff
+	}
+	if err := unix.Sendto(fd, arpProbeFrame(iface.HardwareAddr, ip), 0, addr); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, nil
+		}
+		tv := unix.NsecToTimeval(remaining.Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return nil, err
+		}
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if conflict := arpConflict(buf[:n], iface.HardwareAddr, ip); conflict != nil {
+			return conflict, nil
+		}
+	}
+}
+
+// NamespaceWithIP returns the path of a network namespace on the host
+// holding ip on one of its interfaces, or "" if none does
+func NamespaceWithIP(ip net.IP) (string, error) {
+	hostIps, err := GetHostIPs()
+	if err != nil {
+		return "", err
+	}
+	for _, hostIP := range hostIps {
+		if hostIP.IP.Equal(ip) {
+			return "/proc/self/ns/net", nil
+		}
+	}
+
+	for _, nsPath := range HostNamespaces() {
+		// The process may have exited since
+		nsIps, _ := getIpsInNamespace(nsPath)
+		for _, nsIP := range nsIps {
+			if nsIP.IP.Equal(ip) {
+				return nsPath, nil
+			}
+		}
+	}
+	return "", nil
+}
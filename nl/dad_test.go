@@ -0,0 +1,111 @@
+package nl
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestArpConflict(t *testing.T) {
+	own, _ := net.ParseMAC("02:00:00:00:00:01")
+	other, _ := net.ParseMAC("02:00:00:00:00:02")
+	ip := net.ParseIP("10.0.0.5")
+
+	// Our own probe, looped back
+	if conflict := arpConflict(arpProbeFrame(own, ip), own, ip); conflict != nil {
+		t.Errorf("Own probe reported as conflict %v", conflict)
+	}
+
+	// Another host probing for the same address
+	if conflict := arpConflict(arpProbeFrame(other, ip), own, ip); conflict.String() != other.String() {
+		t.Errorf("Concurrent probe not reported: %v", conflict)
+	}
+
+	// Another host probing for a different address
+	if conflict := arpConflict(arpProbeFrame(other, net.ParseIP("10.0.0.6")), own, ip); conflict != nil {
+		t.Errorf("Unrelated probe reported as conflict %v", conflict)
+	}
+
+	// A host answering for the address
+	reply := arpProbeFrame(other, net.ParseIP("10.0.0.1"))
+	copy(reply[arpSenderIP:], ip.To4())
+	if conflict := arpConflict(reply, own, ip); conflict.String() != other.String() {
+		t.Errorf("Reply not reported: %v", conflict)
+	}
+
+	if conflict := arpConflict(reply[:20], own, ip); conflict != nil {
+		t.Errorf("Truncated frame reported as conflict %v", conflict)
+	}
+}
+
+func TestArpProbe(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: "lyftveth2"},
+		PeerName:  "lyftveth3",
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("veth links not supported: %v", err)
+	}
+	defer func() { _ = netlink.LinkDel(veth) }()
+
+	peer, err := netlink.LinkByName("lyftveth3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := netlink.ParseAddr("10.254.0.5/24")
+	if err := netlink.AddrAdd(peer, addr); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []netlink.Link{veth, peer} {
+		if err := netlink.LinkSetUp(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conflict, err := ArpProbe("lyftveth2", net.ParseIP("10.254.0.5"), time.Second)
+	if err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+	if conflict.String() != peer.Attrs().HardwareAddr.String() {
+		t.Errorf("Expected conflict with %v, got %v", peer.Attrs().HardwareAddr, conflict)
+	}
+
+	conflict, err = ArpProbe("lyftveth2", net.ParseIP("10.254.0.6"), 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+	if conflict != nil {
+		t.Errorf("Unexpected conflict with %v", conflict)
+	}
+}
+
+func TestNamespaceWithIP(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	path, err := NamespaceWithIP(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path == "" {
+		t.Errorf("Loopback address not found")
+	}
+
+	path, err = NamespaceWithIP(net.ParseIP("192.0.2.77"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "" {
+		t.Errorf("Unused address found in %v", path)
+	}
+}
@@ -2,13 +2,12 @@ package nl
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
-	"path/filepath"
+	"sync"
 
-	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 )
 
 // BoundIP contains an IPNet / Label pair
@@ -43,55 +42,82 @@ func getIpsOnHandle(handle *netlink.Handle) ([]BoundIP, error) {
 	return foundIps, nil
 }
 
-// GetIPs returns IPs allocated to interfaces, in all namespaces
+// namespaceScanWorkers bounds how many network namespaces are read at once
+const namespaceScanWorkers = 16
+
+// GetIPs returns IPs allocated to interfaces, in all namespaces of the
+// configured namespace sources
 // TODO: Remove addresses on control plane interfaces, filters
 func GetIPs() ([]BoundIP, error) {
-
-	var namespaces []string
-
-	files, err := ioutil.ReadDir("/var/run/netns/")
-	if err == nil {
-		for _, file := range files {
-			namespaces = append(namespaces,
-				filepath.Join("/var/run/netns", file.Name()))
-		}
-	}
-
-	// Check for running docker containers
-	containers, err := runningDockerContainers()
-	if err == nil {
-		dockerNamespaces := dockerNetworkNamespaces(containers)
-		namespaces = append(namespaces, dockerNamespaces...)
-	}
-
 	// First get all the IPs in the main namespace
-	handle, err := netlink.NewHandle()
+	foundIps, err := GetHostIPs()
 	if err != nil {
 		return nil, err
 	}
-	foundIps, err := getIpsOnHandle(handle)
+	return append(foundIps, GetNamespaceIPs(HostNamespaces())...), nil
+}
+
+// GetHostIPs returns IPs allocated to interfaces in the current namespace
+func GetHostIPs() ([]BoundIP, error) {
+	handle, err := netlink.NewHandle()
 	if err != nil {
 		return nil, err
 	}
+	defer handle.Delete()
+	return getIpsOnHandle(handle)
+}
 
-	// Enter each namesapce, get handles
-	for _, nsPath := range namespaces {
-		err := ns.WithNetNSPath(nsPath, func(_ ns.NetNS) error {
-
-			handle, err = netlink.NewHandle()
-			if err != nil {
-				return err
+// GetNamespaceIPs returns IPs allocated to interfaces in the network
+// namespaces at nsPaths, which are read in parallel. Namespaces which
+// cannot be read, e.g. as their process exited, are skipped.
+func GetNamespaceIPs(nsPaths []string) []BoundIP {
+	paths := make(chan string)
+	results := make(chan []BoundIP)
+
+	var wg sync.WaitGroup
+	for i := 0; i < namespaceScanWorkers && i < len(nsPaths); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for nsPath := range paths {
+				ips, err := getIpsInNamespace(nsPath)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Enumerating namespace failure %v\n", err)
+					continue
+				}
+				results <- ips
 			}
-			defer handle.Delete()
-
-			newIps, err := getIpsOnHandle(handle)
-			foundIps = append(foundIps, newIps...)
-			return err
-		})
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Enumerating namespace failure %v", err)
+		}()
+	}
+	go func() {
+		for _, nsPath := range nsPaths {
+			paths <- nsPath
 		}
+		close(paths)
+		wg.Wait()
+		close(results)
+	}()
+
+	foundIps := []BoundIP{}
+	for ips := range results {
+		foundIps = append(foundIps, ips...)
 	}
+	return foundIps
+}
 
-	return foundIps, nil
+// getIpsInNamespace reads the IPs of a network namespace through a
+// netlink handle opened within it, without moving the calling thread
+func getIpsInNamespace(nsPath string) ([]BoundIP, error) {
+	nsHandle, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer nsHandle.Close()
+
+	handle, err := netlink.NewHandleAt(nsHandle)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Delete()
+	return getIpsOnHandle(handle)
 }
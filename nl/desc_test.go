@@ -0,0 +1,23 @@
+package nl
+
+import (
+	"testing"
+)
+
+func TestGetNamespaceIPs(t *testing.T) {
+	hostIps, err := GetHostIPs()
+	if err != nil {
+		t.Fatalf("unable to list host IPs %v", err)
+	}
+
+	// Unreadable namespaces are skipped
+	nsIps := GetNamespaceIPs([]string{"/proc/self/ns/net", "/nonexistent/ns/net"})
+	if len(nsIps) != len(hostIps) {
+		t.Fatalf("expected %v IPs, got %v", hostIps, nsIps)
+	}
+	for i := range hostIps {
+		if !hostIps[i].IP.Equal(nsIps[i].IP) {
+			t.Errorf("expected %v, got %v", hostIps[i], nsIps[i])
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package nl
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	vnl "github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// IPVlanFlag is the isolation flag of an ipvlan interface
+type IPVlanFlag uint16
+
+// ipvlan isolation flags, see IPVLAN_F_* in linux/if_link.h
+const (
+	IPVlanFlagBridge  IPVlanFlag = 0x0
+	IPVlanFlagPrivate IPVlanFlag = 0x1
+	IPVlanFlagVepa    IPVlanFlag = 0x2
+)
+
+// iflaIPVlanFlags follows IFLA_IPVLAN_MODE, which is all the netlink
+// library knows about
+const iflaIPVlanFlags = vnl.IFLA_IPVLAN_MODE + 1
+
+// IPVlanFlagFromString parses the isolation flag of an ipvlan interface
+func IPVlanFlagFromString(s string) (IPVlanFlag, error) {
+	switch s {
+	case "", "bridge":
+		return IPVlanFlagBridge, nil
+	case "private":
+		return IPVlanFlagPrivate, nil
+	case "vepa":
+		return IPVlanFlagVepa, nil
+	default:
+		return 0, fmt.Errorf("unknown ipvlan flags: %q", s)
+	}
+}
+
+func (f IPVlanFlag) String() string {
+	switch f {
+	case IPVlanFlagBridge:
+		return "bridge"
+	case IPVlanFlagPrivate:
+		return "private"
+	case IPVlanFlagVepa:
+		return "vepa"
+	default:
+		return fmt.Sprintf("0x%x", uint16(f))
+	}
+}
+
+// AddIPVlan creates an ipvlan interface with the given isolation flag.
+// netlink.LinkAdd does not support flags, so the request is built here.
+// Kernels older than 4.15 silently ignore the flag, so it is read back
+// and the interface removed again if it did not stick.
+func AddIPVlan(link *netlink.IPVlan, flag IPVlanFlag) error {
+	if flag == IPVlanFlagBridge {
+		return netlink.LinkAdd(link)
+	}
+
+	attrs := link.Attrs()
+	req := vnl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.AddData(vnl.NewIfInfomsg(unix.AF_UNSPEC))
+	req.AddData(vnl.NewRtAttr(unix.IFLA_IFNAME, vnl.ZeroTerminated(attrs.Name)))
+	req.AddData(vnl.NewRtAttr(unix.IFLA_LINK, vnl.Uint32Attr(uint32(attrs.ParentIndex))))
+	if attrs.MTU > 0 {
+		req.AddData(vnl.NewRtAttr(unix.IFLA_MTU, vnl.Uint32Attr(uint32(attrs.MTU))))
+	}
+	if fd, ok := attrs.Namespace.(netlink.NsFd); ok {
+		req.AddData(vnl.NewRtAttr(unix.IFLA_NET_NS_FD, vnl.Uint32Attr(uint32(fd))))
+	}
+	linkInfo := vnl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	vnl.NewRtAttrChild(linkInfo, vnl.IFLA_INFO_KIND, vnl.NonZeroTerminated("ipvlan"))
+	data := vnl.NewRtAttrChild(linkInfo, vnl.IFLA_INFO_DATA, nil)
+	vnl.NewRtAttrChild(data, vnl.IFLA_IPVLAN_MODE, vnl.Uint16Attr(uint16(link.Mode)))
+	vnl.NewRtAttrChild(data, iflaIPVlanFlags, vnl.Uint16Attr(uint16(flag)))
+	req.AddData(linkInfo)
+
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return err
+	}
+
+	// The interface may have moved to another namespace, where it is
+	// verified by the caller
+	if attrs.Namespace != nil {
+		return nil
+	}
+	return VerifyIPVlanFlag(attrs.Name, flag)
+}
+
+// VerifyIPVlanFlag checks that an ipvlan interface carries the given
+// isolation flag, removing it otherwise
+func VerifyIPVlanFlag(name string, flag IPVlanFlag) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	actual, err := GetIPVlanFlag(link)
+	if err != nil {
+		return err
+	}
+	if actual != flag {
+		_ = netlink.LinkDel(link)
+		return fmt.Errorf("kernel does not support ipvlan flags %v", flag)
+	}
+	return nil
+}
+
+// GetIPVlanFlag returns the isolation flag of an ipvlan interface
+func GetIPVlanFlag(link netlink.Link) (IPVlanFlag, error) {
+	req := vnl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+	msg := vnl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	if err != nil {
+		return 0, err
+	}
+	if len(msgs) == 0 {
+		return 0, fmt.Errorf("link %v not found", link.Attrs().Name)
+	}
+
+	m := msgs[0]
+	attrs, err := vnl.ParseRouteAttr(m[vnl.DeserializeIfInfomsg(m).Len():])
+	if err != nil {
+		return 0, err
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type != unix.IFLA_LINKINFO {
+			continue
+		}
+		infos, err := vnl.ParseRouteAttr(attr.Value)
+		if err != nil {
+			return 0, err
+		}
+		for _, info := range infos {
+			if info.Attr.Type != vnl.IFLA_INFO_DATA {
+				continue
+			}
+			data, err := vnl.ParseRouteAttr(info.Value)
+			if err != nil {
+				return 0, err
+			}
+			for _, datum := range data {
+				if datum.Attr.Type == iflaIPVlanFlags && len(datum.Value) >= 2 {
+					return IPVlanFlag(vnl.NativeEndian().Uint16(datum.Value[0:2])), nil
+				}
+			}
+		}
+	}
+	// Kernels without flag support do not report any
+	return IPVlanFlagBridge, nil
+}
@@ -0,0 +1,77 @@
+package nl
+
+import (
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestIPVlanFlagFromString(t *testing.T) {
+	cases := map[string]IPVlanFlag{
+		"":        IPVlanFlagBridge,
+		"bridge":  IPVlanFlagBridge,
+		"private": IPVlanFlagPrivate,
+		"vepa":    IPVlanFlagVepa,
+	}
+	for s, expected := range cases {
+		flag, err := IPVlanFlagFromString(s)
+		if err != nil {
+			t.Errorf("Error returned for %q: %v", s, err)
+		}
+		if flag != expected {
+			t.Errorf("Invalid flag %v for %q", flag, s)
+		}
+	}
+
+	if _, err := IPVlanFlagFromString("private,vepa"); err == nil {
+		t.Errorf("Conflicting flags accepted")
+	}
+}
+
+func TestAddIPVlan(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	master := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "lyftmaster"}}
+	if err := netlink.LinkAdd(master); err != nil {
+		t.Skipf("Could not add %s: %v", master.Name, err)
+	}
+	defer func() { _ = RemoveInterface(master.Name) }()
+	m, err := netlink.LinkByName(master.Name)
+	if err != nil {
+		t.Fatalf("Failed to find %s: %v", master.Name, err)
+	}
+
+	for _, flag := range []IPVlanFlag{IPVlanFlagBridge, IPVlanFlagPrivate, IPVlanFlagVepa} {
+		link := &netlink.IPVlan{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:        "lyftipvl",
+				ParentIndex: m.Attrs().Index,
+			},
+			Mode: netlink.IPVLAN_MODE_L2,
+		}
+		err := AddIPVlan(link, flag)
+		if err != nil && flag == IPVlanFlagBridge {
+			t.Skipf("Kernel does not support ipvlan: %v", err)
+		}
+		if err != nil {
+			t.Errorf("Failed to add ipvlan with flags %v: %v", flag, err)
+			continue
+		}
+		added, err := netlink.LinkByName(link.Name)
+		if err != nil {
+			t.Fatalf("Failed to find %s: %v", link.Name, err)
+		}
+		actual, err := GetIPVlanFlag(added)
+		if err != nil {
+			t.Errorf("Failed to read ipvlan flags: %v", err)
+		}
+		if actual != flag {
+			t.Errorf("Expected flags %v, got %v", flag, actual)
+		}
+		_ = netlink.LinkDel(added)
+	}
+}
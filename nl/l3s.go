@@ -0,0 +1,133 @@
+package nl
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const hostIpvlanPrefix = "ipvl-"
+
+// HostIpvlanName returns the name of the host namespace ipvlan interface
+// through which the host reaches L3S Pods on master
+func HostIpvlanName(master string) string {
+	name := hostIpvlanPrefix + master
+	if len(name) > syscall.IFNAMSIZ-1 {
+		name = name[:syscall.IFNAMSIZ-1]
+	}
+	return name
+}
+
+// EnsureHostIpvlan creates, if needed, and brings up an ipvlan interface
+// on master in the host namespace. Traffic from the host to Pods on the
+// same master never leaves through the master itself, so it is routed
+// over this interface instead.
+func EnsureHostIpvlan(master string, mode netlink.IPVlanMode) (netlink.Link, error) {
+	name := HostIpvlanName(master)
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		m, err := netlink.LinkByName(master)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup master %q: %v", master, err)
+		}
+		err = netlink.LinkAdd(&netlink.IPVlan{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:        name,
+				ParentIndex: m.Attrs().Index,
+			},
+			Mode: mode,
+		})
+		if err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create host ipvlan %q: %v", name, err)
+		}
+		link, err = netlink.LinkByName(name)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// AddHostRoutes makes an L3S Pod address reachable from the host over the
+// host ipvlan interface, and sends traffic sourced from it through table,
+// which defaults via gw on the Pod's master so it leaves on the ENI owning
+// the address.
+func AddHostRoutes(hostIpvlan netlink.Link, master string, addr net.IP, gw net.IP, table int, priority int) error {
+	m, err := netlink.LinkByName(master)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", master, err)
+	}
+
+	err = netlink.RouteReplace(&netlink.Route{
+		LinkIndex: m.Attrs().Index,
+		Gw:        gw,
+		Table:     table,
+		Flags:     int(netlink.FLAG_ONLINK),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add default route via %v to table %d: %v", gw, table, err)
+	}
+
+	dst := &net.IPNet{IP: addr, Mask: net.CIDRMask(32, 32)}
+	err = netlink.RouteReplace(&netlink.Route{
+		LinkIndex: hostIpvlan.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       dst,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add host route to %v: %v", addr, err)
+	}
+
+	rule := netlink.NewRule()
+	rule.Src = dst
+	rule.Table = table
+	rule.Priority = priority
+	if err := netlink.RuleAdd(rule); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to add source rule for %v: %v", addr, err)
+	}
+	return nil
+}
+
+// DelHostRoutes removes the host route and source rule of an L3S Pod
+// address. The per master table is shared and left in place.
+func DelHostRoutes(addr net.IP, priority int) error {
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Priority != priority || rule.Src == nil || !rule.Src.IP.Equal(addr) {
+			continue
+		}
+		rule.Family = netlink.FAMILY_V4
+		if err := netlink.RuleDel(rule); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove source rule for %v: %v", addr, err)
+		}
+	}
+
+	dst := &net.IPNet{IP: addr, Mask: net.CIDRMask(32, 32)}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: dst}, netlink.RT_FILTER_DST)
+	if err != nil {
+		return err
+	}
+	for i := range routes {
+		link, err := netlink.LinkByIndex(routes[i].LinkIndex)
+		if err != nil || !strings.HasPrefix(link.Attrs().Name, hostIpvlanPrefix) {
+			continue
+		}
+		if err := netlink.RouteDel(&routes[i]); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to remove host route to %v: %v", addr, err)
+		}
+	}
+	return nil
+}
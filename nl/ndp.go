@@ -0,0 +1,69 @@
+package nl
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	ndpOverrideFlag            = 0x20
+	ndpOptTargetLinkLayerAddr  = 2
+	neighborAdvertisementHdrSz = 20
+)
+
+// neighborAdvertisement builds the body of an unsolicited neighbor
+// advertisement (RFC 4861 4.4) for target, carrying the link-layer
+// address of the sending interface
+func neighborAdvertisement(target net.IP, hwAddr net.HardwareAddr) ([]byte, error) {
+	if target.To4() != nil || target.To16() == nil {
+		return nil, fmt.Errorf("not an IPv6 address: %v", target)
+	}
+	if len(hwAddr) != 6 {
+		return nil, fmt.Errorf("unsupported link-layer address %v", hwAddr)
+	}
+
+	body := make([]byte, neighborAdvertisementHdrSz+8)
+	// Unsolicited advertisements set only the override flag
+	body[0] = ndpOverrideFlag
+	copy(body[4:neighborAdvertisementHdrSz], target.To16())
+	body[neighborAdvertisementHdrSz] = ndpOptTargetLinkLayerAddr
+	body[neighborAdvertisementHdrSz+1] = 1 // option length in units of 8 octets
+	copy(body[neighborAdvertisementHdrSz+2:], hwAddr)
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeNeighborAdvertisement,
+		Body: &icmp.RawBody{Data: body},
+	}
+	// The kernel computes the checksum for ICMPv6 raw sockets
+	return msg.Marshal(nil)
+}
+
+// SendUnsolicitedNeighborAdvertisement announces an IPv6 address to all
+// nodes on the link of iface, the IPv6 equivalent of a gratuitous ARP
+func SendUnsolicitedNeighborAdvertisement(target net.IP, iface net.Interface) error {
+	payload, err := neighborAdvertisement(target, iface.HardwareAddr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	pc := conn.IPv6PacketConn()
+	// Neighbor discovery messages must be sent with a hop limit of 255
+	if err := pc.SetMulticastHopLimit(255); err != nil {
+		return err
+	}
+	if err := pc.SetMulticastInterface(&iface); err != nil {
+		return err
+	}
+
+	_, err = conn.WriteTo(payload, &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: iface.Name})
+	return err
+}
@@ -0,0 +1,37 @@
+package nl
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestNeighborAdvertisement(t *testing.T) {
+	target := net.ParseIP("2001:db8::10")
+	hwAddr, _ := net.ParseMAC("02:00:00:00:00:01")
+
+	payload, err := neighborAdvertisement(target, hwAddr)
+	if err != nil {
+		t.Fatalf("failed to build advertisement %v", err)
+	}
+
+	if len(payload) != 32 {
+		t.Fatalf("unexpected advertisement length %v", len(payload))
+	}
+	if payload[0] != 136 {
+		t.Errorf("unexpected ICMPv6 type %v", payload[0])
+	}
+	if payload[4] != ndpOverrideFlag {
+		t.Errorf("override flag not set: %x", payload[4])
+	}
+	if !net.IP(payload[8:24]).Equal(target) {
+		t.Errorf("unexpected target %v", net.IP(payload[8:24]))
+	}
+	if payload[24] != ndpOptTargetLinkLayerAddr || payload[25] != 1 || !bytes.Equal(payload[26:32], hwAddr) {
+		t.Errorf("invalid target link-layer address option %v", payload[24:])
+	}
+
+	if _, err := neighborAdvertisement(net.ParseIP("10.0.0.1"), hwAddr); err == nil {
+		t.Errorf("IPv4 target should be rejected")
+	}
+}
@@ -0,0 +1,271 @@
+package nl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const criTimeout = 5 * time.Second
+
+// NamespaceSource enumerates network namespaces of containers
+type NamespaceSource interface {
+	// Namespaces returns the paths of network namespaces. Sources of
+	// runtimes not present on the host return none.
+	Namespaces() ([]string, error)
+	fmt.Stringer
+}
+
+// DefaultNamespaceSources are the namespace sources used unless
+// configured otherwise
+var DefaultNamespaceSources = []string{"netns", "docker", "cri", "proc"}
+
+var namespaceSources []NamespaceSource
+
+func init() {
+	namespaceSources, _ = ParseNamespaceSources(DefaultNamespaceSources)
+}
+
+// ParseNamespaceSources builds namespace sources from their
+// specifications:
+//   - netns[:dir] - namespaces bind mounted in dir, by default
+//     /var/run/netns and /run/netns
+//   - docker - running Docker containers
+//   - cri[:socket] - ready Pod sandboxes of a CRI runtime such as
+//     containerd or cri-o, by default from their usual sockets
+//   - proc - the namespaces of all processes
+func ParseNamespaceSources(specs []string) ([]NamespaceSource, error) {
+	var sources []NamespaceSource
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		arg := ""
+		if len(parts) == 2 {
+			arg = parts[1]
+		}
+		switch parts[0] {
+		case "netns":
+			if arg == "" {
+				sources = append(sources, &dirSource{dir: "/var/run/netns"}, &dirSource{dir: "/run/netns"})
+			} else {
+				sources = append(sources, &dirSource{dir: arg})
+			}
+		case "docker":
+			sources = append(sources, &dockerSource{})
+		case "cri":
+			if arg == "" {
+				sources = append(sources,
+					&criSource{socket: "/run/containerd/containerd.sock"},
+					&criSource{socket: "/var/run/crio/crio.sock"})
+			} else {
+				sources = append(sources, &criSource{socket: arg})
+			}
+		case "proc":
+			sources = append(sources, &procSource{})
+		default:
+			return nil, fmt.Errorf("unknown namespace source %q", spec)
+		}
+	}
+	return sources, nil
+}
+
+// SetNamespaceSources selects the namespace sources, see
+// ParseNamespaceSources
+func SetNamespaceSources(specs []string) error {
+	sources, err := ParseNamespaceSources(specs)
+	if err != nil {
+		return err
+	}
+	namespaceSources = sources
+	return nil
+}
+
+// HostNamespaces returns the network namespaces of all configured
+// sources, once each and without the current namespace
+func HostNamespaces() []string {
+	type nsID struct {
+		dev uint64
+		ino uint64
+	}
+	idOf := func(path string) (nsID, bool) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nsID{}, false
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nsID{}, false
+		}
+		return nsID{dev: uint64(stat.Dev), ino: stat.Ino}, true
+	}
+
+	seen := make(map[nsID]bool)
+	if id, ok := idOf("/proc/self/ns/net"); ok {
+		seen[id] = true
+	}
+
+	var namespaces []string
+	for _, source := range namespaceSources {
+		paths, err := source.Namespaces()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Enumerating %v namespaces failure %v\n", source, err)
+			continue
+		}
+		for _, path := range paths {
+			id, ok := idOf(path)
+			if ok && !seen[id] {
+				seen[id] = true
+				namespaces = append(namespaces, path)
+			}
+		}
+	}
+	return namespaces
+}
+
+// dirSource lists namespaces bind mounted in a directory, e.g. by ip
+// netns or CNI runtimes
+type dirSource struct {
+	dir string
+}
+
+func (s *dirSource) String() string {
+	return "netns:" + s.dir
+}
+
+func (s *dirSource) Namespaces() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var namespaces []string
+	for _, file := range files {
+		namespaces = append(namespaces, filepath.Join(s.dir, file.Name()))
+	}
+	return namespaces, nil
+}
+
+// dockerSource lists the namespaces of running Docker containers
+type dockerSource struct{}
+
+func (s *dockerSource) String() string {
+	return "docker"
+}
+
+func (s *dockerSource) Namespaces() ([]string, error) {
+	if os.Getenv("DOCKER_HOST") == "" && !fileExists("/var/run/docker.sock") {
+		return nil, nil
+	}
+	containers, err := runningDockerContainers()
+	if err != nil {
+		return nil, err
+	}
+	return dockerNetworkNamespaces(containers), nil
+}
+
+// procSource lists the namespaces of all processes, which includes those
+// of every container runtime
+type procSource struct{}
+
+func (s *procSource) String() string {
+	return "proc"
+}
+
+func (s *procSource) Namespaces() ([]string, error) {
+	return filepath.Glob("/proc/[0-9]*/ns/net")
+}
+
+// criSource lists the namespaces of the ready Pod sandboxes of a CRI
+// runtime
+type criSource struct {
+	socket string
+}
+
+func (s *criSource) String() string {
+	return "cri:" + s.socket
+}
+
+func (s *criSource) Namespaces() ([]string, error) {
+	if !fileExists(s.socket) {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), criTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "unix://"+s.socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := runtimeapi.NewRuntimeServiceClient(conn)
+	sandboxes, err := client.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{
+		Filter: &runtimeapi.PodSandboxFilter{
+			State: &runtimeapi.PodSandboxStateValue{State: runtimeapi.PodSandboxState_SANDBOX_READY},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaces []string
+	for _, sandbox := range sandboxes.Items {
+		status, err := client.PodSandboxStatus(ctx, &runtimeapi.PodSandboxStatusRequest{
+			PodSandboxId: sandbox.Id,
+			Verbose:      true,
+		})
+		if err != nil {
+			// The sandbox may have been removed since
+			continue
+		}
+		if path := criSandboxNamespace(status.Info); path != "" {
+			namespaces = append(namespaces, path)
+		}
+	}
+	return namespaces, nil
+}
+
+// criSandboxNamespace returns the network namespace from the verbose
+// status info of a Pod sandbox: the path in its runtime spec, or else
+// the namespace of its process
+func criSandboxNamespace(info map[string]string) string {
+	var parsed struct {
+		Pid         int `json:"pid"`
+		RuntimeSpec struct {
+			Linux struct {
+				Namespaces []struct {
+					Type string `json:"type"`
+					Path string `json:"path"`
+				} `json:"namespaces"`
+			} `json:"linux"`
+		} `json:"runtimeSpec"`
+	}
+	if err := json.Unmarshal([]byte(info["info"]), &parsed); err != nil {
+		return ""
+	}
+	for _, namespace := range parsed.RuntimeSpec.Linux.Namespaces {
+		if namespace.Type == "network" && namespace.Path != "" {
+			return namespace.Path
+		}
+	}
+	if parsed.Pid > 0 {
+		return fmt.Sprintf("/proc/%d/ns/net", parsed.Pid)
+	}
+	return ""
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
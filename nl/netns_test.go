@@ -0,0 +1,73 @@
+package nl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseNamespaceSources(t *testing.T) {
+	sources, err := ParseNamespaceSources([]string{"netns", "netns:/tmp/netns", "docker", "cri:/run/k3s/containerd/containerd.sock", "proc"})
+	if err != nil {
+		t.Fatalf("Error returned %v", err)
+	}
+	var names []string
+	for _, source := range sources {
+		names = append(names, source.String())
+	}
+	expected := []string{"netns:/var/run/netns", "netns:/run/netns", "netns:/tmp/netns", "docker", "cri:/run/k3s/containerd/containerd.sock", "proc"}
+	if len(names) != len(expected) {
+		t.Fatalf("Invalid sources %v", names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Invalid sources %v", names)
+			break
+		}
+	}
+
+	if _, err = ParseNamespaceSources([]string{"rkt"}); err == nil {
+		t.Errorf("Unknown source accepted")
+	}
+}
+
+func TestCriSandboxNamespace(t *testing.T) {
+	// containerd
+	info := map[string]string{"info": `{"pid": 42, "runtimeSpec": {"linux": {"namespaces": [
+		{"type": "pid"}, {"type": "network", "path": "/var/run/netns/cni-1234"}]}}}`}
+	if path := criSandboxNamespace(info); path != "/var/run/netns/cni-1234" {
+		t.Errorf("Invalid namespace %q", path)
+	}
+
+	info = map[string]string{"info": `{"pid": 42}`}
+	if path := criSandboxNamespace(info); path != "/proc/42/ns/net" {
+		t.Errorf("Invalid namespace %q", path)
+	}
+
+	if path := criSandboxNamespace(map[string]string{}); path != "" {
+		t.Errorf("Namespace %q from empty info", path)
+	}
+}
+
+func TestHostNamespacesDeduplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The same namespace through a link and a process
+	if err := os.Symlink("/proc/1/ns/net", filepath.Join(dir, "init")); err != nil {
+		t.Fatal(err)
+	}
+	defer func(sources []NamespaceSource) { namespaceSources = sources }(namespaceSources)
+	if err := SetNamespaceSources([]string{"netns:" + dir, "netns:" + dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	namespaces := HostNamespaces()
+	if len(namespaces) > 1 {
+		t.Errorf("Namespaces not deduplicated %v", namespaces)
+	}
+}
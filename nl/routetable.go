@@ -0,0 +1,78 @@
+package nl
+
+import (
+	"github.com/vishvananda/netlink"
+)
+
+var ruleFamilies = []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+
+// RouteTablesInUse returns the set of tables referenced by any policy
+// routing rule, combining V4 and V6 rules
+func RouteTablesInUse() (map[int]bool, error) {
+	tables := make(map[int]bool)
+	for _, family := range ruleFamilies {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			tables[rule.Table] = true
+		}
+	}
+	return tables, nil
+}
+
+// StaleRouteTables returns tables at or above start which are selected by
+// an incoming interface rule whose interface no longer exists
+func StaleRouteTables(start int) ([]int, error) {
+	var stale []int
+	seen := make(map[int]bool)
+	for _, family := range ruleFamilies {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			if rule.Table < start || rule.IifName == "" || seen[rule.Table] {
+				continue
+			}
+			_, err := netlink.LinkByName(rule.IifName)
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				seen[rule.Table] = true
+				stale = append(stale, rule.Table)
+			}
+		}
+	}
+	return stale, nil
+}
+
+// FlushRouteTable removes all rules selecting a table and all routes
+// within it
+func FlushRouteTable(table int) error {
+	for _, family := range ruleFamilies {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return err
+		}
+		for i := range rules {
+			if rules[i].Table != table {
+				continue
+			}
+			rules[i].Family = family
+			if err := netlink.RuleDel(&rules[i]); err != nil {
+				return err
+			}
+		}
+
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return err
+		}
+		for i := range routes {
+			if err := netlink.RouteDel(&routes[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"os"
 	"runtime"
 	"time"
 
@@ -29,6 +30,7 @@ import (
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
 
 	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
@@ -36,6 +38,9 @@ import (
 	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
 
+// arpProbeTimeout is how long other hosts have to answer an ARP probe
+const arpProbeTimeout = 300 * time.Millisecond
+
 // PluginConf contains configuration parameters
 type PluginConf struct {
 	Name             string            `json:"name"`
@@ -44,10 +49,71 @@ type PluginConf struct {
 	SubnetTags       map[string]string `json:"subnetTags"`
 	IfaceIndex       int               `json:"interfaceIndex"`
 	SkipDeallocation bool              `json:"skipDeallocation"`
-	RouteToVPCPeers  bool              `json:"routeToVpcPeers"`
 	ReuseIPWait      int               `json:"reuseIPWait"`
 	IPBatchSize      int64             `json:"ipBatchSize"`
-	RouteToCidrs     []string          `json:"routeToCidrs"`
+	aws.RouteConf
+
+	// Pods use the DNS nameservers, search domains and options given,
+	// or the VPC resolver when no nameserver is. VPCResolverFallback
+	// adds the VPC resolver after the given nameservers.
+	DNS                 types.DNS `json:"dns"`
+	VPCResolverFallback bool      `json:"vpcResolverFallback"`
+
+	// Free IPs are ARP probed on the subnet of their interface before
+	// being reused with ArpProbe
+	ArpProbe bool `json:"arpProbe"`
+
+	// NamespaceSources select where the network namespaces of Pods
+	// are looked up to find the IPs in use. IPs handed out and released
+	// are tracked, and only reconciled with the namespaces every
+	// ReconcileInterval seconds.
+	NamespaceSources  []string `json:"namespaceSources"`
+	ReconcileInterval int      `json:"reconcileInterval"`
+
+	// StateDir holds the registry and the state shared by the plugins
+	// and the tool
+	StateDir string `json:"stateDir"`
+
+	// Pods get IPsPerPod IPs, each on a different interface. The
+	// interface of the n-th IP has the n-th SecGroupIdsPerIP groups,
+	// if given.
+	IPsPerPod        int        `json:"ipsPerPod"`
+	SecGroupIdsPerIP [][]string `json:"secGroupIdsPerIp"`
+
+	// Elastic IPs are associated with the Pod IP when ElasticIP is set
+	// or requested through the CNI args convention, e.g. by Multus from
+	// a Pod annotation
+	ElasticIP         bool              `json:"elasticIp"`
+	ElasticIPPoolTags map[string]string `json:"elasticIpPoolTags"`
+	ElasticIPAllocate bool              `json:"elasticIpAllocate"`
+	Args              *struct {
+		CNI struct {
+			ElasticIP bool `json:"elasticIp"`
+		} `json:"cni"`
+	} `json:"args"`
+}
+
+// K8sArgs are the arguments kubelet passes to CNI plugins in CNI_ARGS
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE types.UnmarshallableString // nolint: golint
+	K8S_POD_NAME      types.UnmarshallableString // nolint: golint
+}
+
+// ownerOf returns the owner of the IPs handed out for args, recorded in
+// the registry
+func ownerOf(args *skel.CmdArgs) aws.IPOwner {
+	owner := aws.IPOwner{ContainerID: args.ContainerID}
+	k8sArgs := K8sArgs{}
+	if err := types.LoadArgs(args.Args, &k8sArgs); err == nil && k8sArgs.K8S_POD_NAME != "" {
+		owner.Pod = fmt.Sprintf("%s/%s", k8sArgs.K8S_POD_NAMESPACE, k8sArgs.K8S_POD_NAME)
+	}
+	return owner
+}
+
+// wantsElasticIP returns whether the Pod requested an Elastic IP
+func (conf *PluginConf) wantsElasticIP() bool {
+	return conf.ElasticIP || (conf.Args != nil && conf.Args.CNI.ElasticIP)
 }
 
 func init() {
@@ -60,30 +126,69 @@ func init() {
 // parseConfig parses the supplied configuration from stdin.
 func parseConfig(stdin []byte) (*PluginConf, error) {
 	conf := PluginConf{
-		ReuseIPWait: 60, // default 60 second wait
-		IPBatchSize: 1,  // default 1 (backward compatibility)
+		ReuseIPWait:       60,  // default 60 second wait
+		ReconcileInterval: 300, // default 5 minutes between namespace scans
+		IPBatchSize:       1,   // default 1 (backward compatibility)
+		IPsPerPod:         1,
 	}
 
 	if err := json.Unmarshal(stdin, &conf); err != nil {
 		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
 	}
+	lib.SetStatePath(conf.StateDir)
 
 	if conf.SecGroupIds == nil {
 		return nil, fmt.Errorf("secGroupIds must be specified")
 	}
 
+	if len(conf.SecGroupIdsPerIP) > conf.IPsPerPod {
+		conf.IPsPerPod = len(conf.SecGroupIdsPerIP)
+	}
+	if conf.IPsPerPod < 1 {
+		return nil, fmt.Errorf("ipsPerPod must be at least 1")
+	}
+
+	if conf.wantsElasticIP() && len(conf.ElasticIPPoolTags) == 0 {
+		return nil, fmt.Errorf("elasticIpPoolTags must be specified to use Elastic IPs")
+	}
+
+	if conf.ReconcileInterval < 0 {
+		return nil, fmt.Errorf("reconcileInterval must not be negative")
+	}
+	aws.ReconcileInterval = time.Duration(conf.ReconcileInterval) * time.Second
+
+	if conf.NamespaceSources != nil {
+		if err := nl.SetNamespaceSources(conf.NamespaceSources); err != nil {
+			return nil, err
+		}
+	}
+
 	return &conf, nil
 }
 
-// cmdAdd is called for ADD requests
-func cmdAdd(args *skel.CmdArgs) error {
-	conf, err := parseConfig(args.StdinData)
-	if err != nil {
-		return err
+// sameGroups returns whether two lists hold the same security groups
+func sameGroups(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	groups := make(map[string]bool, len(a))
+	for _, group := range a {
+		groups[group] = true
 	}
+	for _, group := range b {
+		if !groups[group] {
+			return false
+		}
+	}
+	return true
+}
 
+// allocate finds or allocates an IP on an interface accepted by filter,
+// creating a new interface with secGroupIds if none has room. The IP is
+// recorded as allocating to owner.
+func allocate(conf *PluginConf, registry *aws.Registry, owner aws.IPOwner, secGroupIds []string, filter aws.InterfaceFilter) (*aws.AllocationResult, error) {
 	var alloc *aws.AllocationResult
-	registry := &aws.Registry{}
+	reused := false
 
 	// Try to find a free IP first - possibly from a broken
 	// container, or torn down namespace. IP must also be at least
@@ -91,18 +196,33 @@ func cmdAdd(args *skel.CmdArgs) error {
 	// considered for use.
 	free, err := aws.FindFreeIPsAtIndex(conf.IfaceIndex, true)
 	if err == nil || len(free) > 0 {
-		registryFreeIPs, err := registry.TrackedBefore(time.Now().Add(time.Duration(-conf.ReuseIPWait) * time.Second))
+		reuseBefore := time.Now().Add(time.Duration(-conf.ReuseIPWait) * time.Second)
+		registryFreeIPs, err := registry.TrackedBefore(reuseBefore)
 		if err == nil && len(registryFreeIPs) > 0 {
 		loop:
 			for _, freeAlloc := range free {
+				if !filter(freeAlloc.Interface) {
+					continue
+				}
 				for _, freeRegistry := range registryFreeIPs {
 					if freeAlloc.IP.Equal(freeRegistry) {
-						alloc = freeAlloc
-						// update timestamp
-						err := registry.TrackIP(freeRegistry)
+						// Another ADD may be reusing the same IP
+						claimed, err := registry.ClaimFreeIP(freeRegistry, reuseBefore, freeAlloc.Interface, owner)
 						if err != nil {
-							return fmt.Errorf("failed to track ip: %s", err)
+							return nil, fmt.Errorf("failed to track ip: %s", err)
+						}
+						if !claimed {
+							break
 						}
+						if holder := duplicateAddress(conf, freeAlloc); holder != "" {
+							fmt.Fprintf(os.Stderr, "Warning: quarantining free IP %v in use by %v\n", freeRegistry, holder)
+							if err := registry.QuarantineIP(freeRegistry); err != nil {
+								return nil, fmt.Errorf("failed to quarantine ip: %s", err)
+							}
+							break
+						}
+						alloc = freeAlloc
+						reused = true
 						break loop
 					}
 				}
@@ -112,103 +232,275 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	// No free IPs available for use, so let's allocate one
 	if alloc == nil {
-		// allocate IPs on an available interface
-		allocs, err := aws.DefaultClient.AllocateIPsFirstAvailableAtIndex(conf.IfaceIndex, conf.IPBatchSize)
-		if err == nil || len(allocs) > 0 {
-			alloc = allocs[0]
-		} else {
-			// failed, so attempt to add an IP to a new interface
-			newIf, err := aws.DefaultClient.NewInterface(conf.SecGroupIds, conf.SubnetTags, conf.IPBatchSize)
-			if err != nil || len(newIf.IPv4s) < 1 {
-				return fmt.Errorf("unable to create a new elastic network interface due to %v",
-					err)
+		allocs, err := allocateNew(conf, secGroupIds, filter)
+		if err != nil {
+			return nil, err
+		}
+		// Claim the first allocated IP, which no other ADD could have
+		// been handed
+		for _, newAlloc := range allocs {
+			claimed, err := registry.ClaimFreeIP(*newAlloc.IP, time.Now(), newAlloc.Interface, owner)
+			if err != nil {
+				return nil, fmt.Errorf("failed to track ip: %s", err)
 			}
-			// Freshly allocated interfaces will always have at least one valid IP - use
-			// this IP address.
-			alloc = &aws.AllocationResult{
-				IP:        &newIf.IPv4s[0],
-				Interface: *newIf,
+			if claimed {
+				alloc = newAlloc
+				break
 			}
 		}
+		if alloc == nil {
+			return nil, fmt.Errorf("unable to claim any of %v allocated IPs", len(allocs))
+		}
 	}
 
-	// Per https://docs.aws.amazon.com/AmazonVPC/latest/UserGuide/VPC_Subnets.html
-	// subnet + 1 is our gateway
-	// primary cidr + 2 is the dns server
-	subnetAddr := alloc.Interface.SubnetCidr.IP.To4()
-	gw := append(subnetAddr[:3], subnetAddr[3]+1)
-	vpcPrimaryAddr := alloc.Interface.VpcPrimaryCidr.IP.To4()
-	dns := append(vpcPrimaryAddr[:3], vpcPrimaryAddr[3]+2)
-	addr := net.IPNet{
-		IP:   *alloc.IP,
-		Mask: alloc.Interface.SubnetCidr.Mask,
+	// Ensure the master interface is always up
+	master := alloc.Interface.LocalName()
+	err = nl.UpInterfacePoll(master)
+	if err != nil {
+		return nil, fmt.Errorf("unable to bring up interface %v due to %v",
+			master, err)
 	}
 
-	master := alloc.Interface.LocalName()
+	// The previous Pod of a reused IP may still be known to the host
+	// and to the VPC, and may have left an Elastic IP on it
+	if reused {
+		if err := aws.ReleasePodElasticIP(*alloc.IP); err != nil {
+			_ = registry.TrackIP(*alloc.IP)
+			return nil, fmt.Errorf("unable to disassociate a stale Elastic IP from %v due to %v", *alloc.IP, err)
+		}
+		forgetIP(*alloc.IP)
+		_ = arping.GratuitousArpOverIfaceByName(*alloc.IP, master)
+	}
+
+	return alloc, nil
+}
 
-	iface := &current.Interface{
-		Name: master,
+// allocateNew allocates IPs on an interface accepted by filter, creating a
+// new interface with secGroupIds if none has room. Interfaces are created
+// holding the attach lock, after checking again for room under it, so
+// concurrent ADDs don't each create one.
+func allocateNew(conf *PluginConf, secGroupIds []string, filter aws.InterfaceFilter) ([]*aws.AllocationResult, error) {
+	allocs, err := aws.DefaultClient.AllocateIPsFirstAvailableMatching(conf.IfaceIndex, conf.IPBatchSize, filter)
+	if err == nil && len(allocs) > 0 {
+		return allocs, nil
 	}
 
-	// Ensure the master interface is always up
-	err = nl.UpInterfacePoll(master)
+	err = lib.WithLockTimeout(lib.LockInterfaceAttach, func() error {
+		allocs, err = aws.DefaultClient.AllocateIPsFirstAvailableMatching(conf.IfaceIndex, conf.IPBatchSize, filter)
+		if err == nil && len(allocs) > 0 {
+			return nil
+		}
+
+		// failed, so attempt to add an IP to a new interface
+		newIf, err := aws.DefaultClient.NewInterface(secGroupIds, conf.SubnetTags, conf.IPBatchSize)
+		if err != nil || len(newIf.IPv4s) < 1 {
+			return fmt.Errorf("unable to create a new elastic network interface due to %v",
+				err)
+		}
+		// Freshly allocated interfaces will always have at least one valid IP
+		allocs = make([]*aws.AllocationResult, 0, len(newIf.IPv4s))
+		for i := range newIf.IPv4s {
+			allocs = append(allocs, &aws.AllocationResult{
+				IP:        &newIf.IPv4s[i],
+				Interface: *newIf,
+			})
+		}
+		return nil
+	})
+	return allocs, err
+}
+
+// duplicateAddress returns who holds a free IP before it is reused: a
+// container in the in-use inventory or, with ArpProbe, a network
+// namespace on the host or another host answering on the subnet of its
+// interface. It returns "" if the IP is unused. Namespaces are otherwise
+// only scanned by the periodic reconciliation of the inventory.
+func duplicateAddress(conf *PluginConf, alloc *aws.AllocationResult) string {
+	inUse, err := (&lib.InUseIPs{}).Lookup(*alloc.IP)
 	if err != nil {
-		return fmt.Errorf("unable to bring up interface %v due to %v",
-			master, err)
+		fmt.Fprintf(os.Stderr, "Warning: failed to look up %v in the in-use IPs: %v\n", alloc.IP, err)
 	}
-
-	ipconfig := &current.IPConfig{
-		Version:   "4",
-		Address:   addr,
-		Gateway:   gw,
-		Interface: current.Int(0),
+	if inUse != nil {
+		if inUse.ContainerID != "" {
+			return inUse.ContainerID
+		}
+		return "a network namespace"
 	}
 
-	result := &current.Result{}
-	rDNS := types.DNS{}
-	rDNS.Nameservers = append(rDNS.Nameservers, dns.String())
-	result.DNS = rDNS
-	result.IPs = append(result.IPs, ipconfig)
-	result.Interfaces = append(result.Interfaces, iface)
-
-	cidrs := alloc.Interface.VpcCidrs
-	if aws.HasBugBrokenVPCCidrs(aws.DefaultClient) {
-		cidrs, err = aws.DefaultClient.DescribeVPCCIDRs(alloc.Interface.VpcID)
+	if conf.ArpProbe {
+		nsPath, err := nl.NamespaceWithIP(*alloc.IP)
 		if err != nil {
-			return fmt.Errorf("Unable to enumerate CIDRs from the AWS API due to a specific meta-data bug %v", err)
+			fmt.Fprintf(os.Stderr, "Warning: failed to scan namespaces for %v: %v\n", alloc.IP, err)
+		}
+		if nsPath != "" {
+			return nsPath
 		}
-	}
 
-	if conf.RouteToVPCPeers {
-		peerCidr, err := aws.DefaultClient.DescribeVPCPeerCIDRs(alloc.Interface.VpcID)
+		hwAddr, err := nl.ArpProbe(alloc.Interface.LocalName(), *alloc.IP, arpProbeTimeout)
 		if err != nil {
-			return fmt.Errorf("unable to enumerate peer CIDrs %v", err)
+			fmt.Fprintf(os.Stderr, "Warning: failed to probe %v: %v\n", alloc.IP, err)
+		}
+		if hwAddr != nil {
+			return hwAddr.String()
 		}
-		cidrs = append(cidrs, peerCidr...)
 	}
+	return ""
+}
 
-	if conf.RouteToCidrs != nil {
-		for _, cidr := range conf.RouteToCidrs {
-			_, parsed, err := net.ParseCIDR(cidr)
-			if err != nil {
-				return fmt.Errorf("unable to parse routeToCidrs element %v", err)
-			}
-			cidrs = append(cidrs, parsed)
+// forgetIP removes the host conntrack and veth neighbor entries of a
+// released or reused Pod IP, which could otherwise misroute traffic to
+// the next Pod using it. Failures are only reported, as they must not
+// prevent IPs from being released.
+func forgetIP(ip net.IP) {
+	if _, err := nl.FlushConntrack(ip); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to flush conntrack entries of %v: %v\n", ip, err)
+	}
+	if err := nl.FlushNeighbors(ip); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to flush neighbor entries of %v: %v\n", ip, err)
+	}
+}
+
+// reconcileAfterBoot drops the IPs of Pods lost in a reboot from the
+// persisted state, on the first call after each boot. Failures are only
+// reported, and retried by the next call.
+func reconcileAfterBoot() {
+	if err := aws.ReconcileAfterBoot(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to reconcile state after boot: %v\n", err)
+	}
+}
+
+// gatewayFor returns the gateway of an interface's subnet. Per
+// https://docs.aws.amazon.com/AmazonVPC/latest/UserGuide/VPC_Subnets.html
+// subnet + 1 is our gateway
+func gatewayFor(intf aws.Interface) net.IP {
+	subnetAddr := intf.SubnetCidr.IP.To4()
+	return net.IPv4(subnetAddr[0], subnetAddr[1], subnetAddr[2], subnetAddr[3]+1).To4()
+}
+
+// dnsFor returns the DNS settings of Pods on intf. The primary cidr + 2
+// is the VPC (Route 53) resolver.
+func dnsFor(conf *PluginConf, intf aws.Interface) types.DNS {
+	vpcPrimaryAddr := intf.VpcPrimaryCidr.IP.To4()
+	resolver := net.IPv4(vpcPrimaryAddr[0], vpcPrimaryAddr[1], vpcPrimaryAddr[2], vpcPrimaryAddr[3]+2)
+
+	dns := conf.DNS
+	if len(dns.Nameservers) == 0 || conf.VPCResolverFallback {
+		dns = lib.MergeDNS(types.DNS{Nameservers: []string{resolver.String()}}, dns)
+	}
+	return dns
+}
+
+// cmdAdd is called for ADD requests
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	reconcileAfterBoot()
+
+	registry := &aws.Registry{}
+	inUse := &lib.InUseIPs{}
+	owner := ownerOf(args)
+
+	// Every IP of the Pod is on a different interface, so each gets
+	// its own ipvlan
+	var allocs []*aws.AllocationResult
+	// A failed ADD may never get a DEL, so leave the IPs claimed so far
+	// free for the next Pod on any failure
+	added, associated := false, false
+	defer func() {
+		if added {
+			return
+		}
+		if associated {
+			_ = aws.ReleasePodElasticIP(*allocs[0].IP)
+		}
+		for _, a := range allocs {
+			_ = inUse.Remove(*a.IP)
+			_ = registry.TrackIP(*a.IP)
+		}
+	}()
+	used := make(map[string]bool)
+	for i := 0; i < conf.IPsPerPod; i++ {
+		secGroupIds := conf.SecGroupIds
+		if i < len(conf.SecGroupIdsPerIP) {
+			secGroupIds = conf.SecGroupIdsPerIP[i]
+		}
+		// Without explicit groups, any interface is acceptable as before
+		checkGroups := i < len(conf.SecGroupIdsPerIP)
+		filter := func(intf aws.Interface) bool {
+			return !used[intf.ID] && (!checkGroups || sameGroups(intf.SecurityGroupIds, secGroupIds))
+		}
+
+		alloc, err := allocate(conf, registry, owner, secGroupIds, filter)
+		if err != nil {
+			return err
 		}
+		used[alloc.Interface.ID] = true
+		allocs = append(allocs, alloc)
 	}
+	alloc := allocs[0]
 
-	// add routes for all VPC cidrs via the subnet gateway
+	gw := gatewayFor(alloc.Interface)
+
+	result := &current.Result{}
+	result.DNS = dnsFor(conf, alloc.Interface)
+
+	for i, a := range allocs {
+		result.Interfaces = append(result.Interfaces, &current.Interface{
+			Name: a.Interface.LocalName(),
+		})
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Version: "4",
+			Address: net.IPNet{
+				IP:   *a.IP,
+				Mask: a.Interface.SubnetCidr.Mask,
+			},
+			Gateway:   gatewayFor(a.Interface),
+			Interface: current.Int(i),
+		})
+	}
+
+	cidrs, err := aws.PodRouteCIDRs(alloc.Interface, &conf.RouteConf)
+	if err != nil {
+		return err
+	}
+
+	// add routes for all VPC cidrs via the subnet gateway of the first IP
 	for _, dst := range cidrs {
 		result.Routes = append(result.Routes, &types.Route{Dst: *dst, GW: gw})
 	}
 
-	// remove the IP from the registry just before handing off to ipvlan
-	err = registry.ForgetIP(*alloc.IP)
-	if err != nil {
-		return fmt.Errorf("failed to forget ip: %s", err)
+	// Pods with an Elastic IP reach the internet over their ENI rather
+	// than being masqueraded behind the host
+	if conf.wantsElasticIP() {
+		_, err := aws.AssociatePodElasticIP(alloc, conf.ElasticIPPoolTags, conf.ElasticIPAllocate)
+		if err != nil {
+			return fmt.Errorf("unable to associate an Elastic IP due to %v", err)
+		}
+		associated = true
+		_, defaultDst, _ := net.ParseCIDR("0.0.0.0/0")
+		result.Routes = append(result.Routes, &types.Route{Dst: *defaultDst, GW: gw})
 	}
 
-	return types.PrintResult(result, conf.CNIVersion)
+	// mark the IPs in use just before handing off to ipvlan
+	for _, a := range allocs {
+		err = registry.MarkInUse(*a.IP, a.Interface, owner)
+		if err != nil {
+			return fmt.Errorf("failed to mark ip in use: %s", err)
+		}
+		err = inUse.Add(*a.IP, args.ContainerID)
+		if err != nil {
+			return fmt.Errorf("failed to record ip in use: %s", err)
+		}
+	}
+
+	if err = types.PrintResult(result, conf.CNIVersion); err != nil {
+		return err
+	}
+	added = true
+	return nil
 }
 
 // cmdDel is called for DELETE requests
@@ -217,34 +509,84 @@ func cmdDel(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-	_ = conf
+	reconcileAfterBoot()
 
 	var addrs []netlink.Addr
 
-	// enter the namespace to grab the list of IPs
+	// enter the namespace to grab the list of IPs of all ipvlans, as
+	// Pods may have one per interface
 	_ = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		iface, err := netlink.LinkByName(args.IfName)
+		links, err := netlink.LinkList()
 		if err != nil {
 			return err
 		}
-		addrs, err = netlink.AddrList(iface, netlink.FAMILY_V4)
-		return err
+		for _, link := range links {
+			if link.Type() != "ipvlan" {
+				continue
+			}
+			linkAddrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			if err != nil {
+				return err
+			}
+			addrs = append(addrs, linkAddrs...)
+		}
+		return nil
 	})
 
-	registry := &aws.Registry{}
+	// The namespace may already be gone, release the IPs handed out to
+	// the container as well
+	inUse := &lib.InUseIPs{}
+	ips := make([]net.IP, 0, len(addrs))
+	seen := make(map[string]bool)
 	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+		seen[addr.IP.String()] = true
+	}
+	containerIPs, err := inUse.ContainerIPs(args.ContainerID)
+	if err != nil {
+		return fmt.Errorf("failed to look up ips in use: %s", err)
+	}
+	for _, ip := range containerIPs {
+		if !seen[ip.String()] {
+			ips = append(ips, ip)
+		}
+	}
+
+	registry := &aws.Registry{}
+	for _, ip := range ips {
+		// return any Elastic IP to the pool, even if this DEL lacks
+		// the args of the ADD which asked for it
+		err := aws.ReleasePodElasticIP(ip)
+		if err != nil {
+			return fmt.Errorf("failed to disassociate Elastic IP: %s", err)
+		}
 		if !conf.SkipDeallocation {
+			err := registry.MarkDeallocating(ip)
+			if err != nil {
+				return fmt.Errorf("failed to track ip: %s", err)
+			}
 			// deallocate IPs outside of the namespace so creds are correct
-			err := aws.DefaultClient.DeallocateIP(&addr.IP)
+			err = aws.DefaultClient.DeallocateIP(&ip)
 			if err != nil {
+				_ = registry.AbortDeallocation(ip)
 				return fmt.Errorf("failed to deallocate ip: %s", err)
 			}
+			err = registry.ForgetIP(ip)
+			if err != nil {
+				return fmt.Errorf("failed to forget ip: %s", err)
+			}
+		} else {
+			// Mark this IP as free in the registry
+			err := registry.TrackIP(ip)
+			if err != nil {
+				return fmt.Errorf("failed to track ip: %s", err)
+			}
 		}
-		// Mark this IP as free in the registry
-		err := registry.TrackIP(addr.IP)
+		err = inUse.Remove(ip)
 		if err != nil {
-			return fmt.Errorf("failed to track ip: %s", err)
+			return fmt.Errorf("failed to forget ip in use: %s", err)
 		}
+		forgetIP(ip)
 	}
 
 	return nil
@@ -257,9 +599,5 @@ func cmdCheck(args *skel.CmdArgs) error {
 }
 
 func main() {
-	run := func() error {
-		skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports(version.Current()), "ipam")
-		return nil
-	}
-	_ = lib.LockfileRun(run)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports(version.Current()), "ipam")
 }
@@ -18,7 +18,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"runtime"
+	"strings"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -28,6 +30,10 @@ import (
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
 
 // NetConf contains network configuration parameters
@@ -39,14 +45,49 @@ type NetConf struct {
 	RawPrevResult *map[string]interface{} `json:"prevResult"`
 	PrevResult    *current.Result         `json:"-"`
 
-	Master string `json:"master"`
-	Mode   string `json:"mode"`
-	MTU    int    `json:"mtu"`
+	Master     string `json:"master"`
+	Mode       string `json:"mode"`
+	Flags      string `json:"flags"`
+	MTU        int    `json:"mtu"`
+	TableStart int    `json:"routeTableStart"`
+
+	// Pods with IPs on several interfaces get one ipvlan per master,
+	// the first named after the CNI interface and the others suffixed
+	// with IfNameSuffix and their position
+	IfNameSuffix string `json:"ifNameSuffix"`
+
+	// MTUs of the routes over the first ipvlan, by the path their
+	// traffic takes
+	VPCRouteMTU             int            `json:"vpcRouteMtu"`
+	PeerRouteMTU            int            `json:"peerRouteMtu"`
+	InterRegionPeerRouteMTU int            `json:"interRegionPeerRouteMtu"`
+	TransitGatewayRouteMTU  int            `json:"transitGatewayRouteMtu"`
+	ExternalRouteMTU        int            `json:"externalRouteMtu"`
+	DefaultRouteMTU         int            `json:"defaultRouteMtu"`
+	RouteMTUs               map[string]int `json:"routeMtus"`
+	DetectRouteMTU          bool           `json:"detectRouteMtu"`
+
+	// StateDir holds the state shared by the plugins and the tool
+	StateDir string `json:"stateDir"`
+
+	masters   []string
+	routeMTUs lib.RouteMTUs
 }
 
 const (
 	cniAdd = iota
 	cniDel
+	cniCheck
+)
+
+// l3sRulePriority is the priority of the source rules sending L3S Pod
+// traffic out of the ENI owning the Pod address
+const l3sRulePriority = 2048
+
+// constants for the source routing of additional ipvlans in the Pod
+const (
+	podRulePriority = 1024
+	podTableStart   = 100
 )
 
 func init() {
@@ -57,10 +98,14 @@ func init() {
 }
 
 func loadConf(bytes []byte, cmd int) (*NetConf, string, error) {
-	n := &NetConf{}
+	n := &NetConf{
+		TableStart:   256,
+		IfNameSuffix: "-",
+	}
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
+	lib.SetStatePath(n.StateDir)
 	// Parse previous result
 	if n.RawPrevResult != nil {
 		resultBytes, err := json.Marshal(n.RawPrevResult)
@@ -77,15 +122,47 @@ func loadConf(bytes []byte, cmd int) (*NetConf, string, error) {
 			return nil, "", fmt.Errorf("could not convert result to current version: %v", err)
 		}
 	}
-	if n.Master == "" && cmd != cniDel {
+	n.routeMTUs = lib.RouteMTUs{
+		VPC:             n.VPCRouteMTU,
+		Peer:            n.PeerRouteMTU,
+		InterRegionPeer: n.InterRegionPeerRouteMTU,
+		TransitGateway:  n.TransitGatewayRouteMTU,
+		External:        n.ExternalRouteMTU,
+		Default:         n.DefaultRouteMTU,
+		CIDRs:           n.RouteMTUs,
+	}
+	if n.DetectRouteMTU {
+		n.routeMTUs.Detect()
+	}
+	if err := n.routeMTUs.Validate(); err != nil {
+		return nil, "", err
+	}
+	flag, err := nl.IPVlanFlagFromString(n.Flags)
+	if err != nil {
+		return nil, "", err
+	}
+	// Flags apply to every ipvlan on a master, including the host side
+	// interface of L3S mode, which must reach the Pods directly
+	if n.Mode == "l3s" && flag != nl.IPVlanFlagBridge {
+		return nil, "", fmt.Errorf("ipvlan flags %q are not supported in l3s mode", n.Flags)
+	}
+	if n.Master != "" {
+		n.masters = []string{n.Master}
+	} else if cmd == cniAdd {
 		if n.PrevResult == nil {
 			return nil, "", fmt.Errorf(`"master" field is required. It specifies the host interface name to virtualize`)
 		}
-		if len(n.PrevResult.Interfaces) == 1 && n.PrevResult.Interfaces[0].Name != "" {
-			n.Master = n.PrevResult.Interfaces[0].Name
-		} else {
-			return nil, "", fmt.Errorf("chained master failure. PrevResult lacks a single named interface")
+		// Every interface of the IPAM result is a master
+		for _, iface := range n.PrevResult.Interfaces {
+			if iface.Name == "" || iface.Sandbox != "" {
+				return nil, "", fmt.Errorf("chained master failure. PrevResult interfaces must be named host interfaces")
+			}
+			n.masters = append(n.masters, iface.Name)
+		}
+		if len(n.masters) == 0 {
+			return nil, "", fmt.Errorf("chained master failure. PrevResult lacks a named interface")
 		}
+		n.Master = n.masters[0]
 	}
 	return n, n.CNIVersion, nil
 }
@@ -103,17 +180,38 @@ func modeFromString(s string) (netlink.IPVlanMode, error) {
 	}
 }
 
-func createIpvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
+// masterInterface describes the host side master of an ipvlan
+func masterInterface(master string) *current.Interface {
+	iface := &current.Interface{Name: master}
+	if m, err := netlink.LinkByName(master); err == nil {
+		iface.Mac = m.Attrs().HardwareAddr.String()
+	}
+	return iface
+}
+
+// childName returns the name of the ipvlan on the n-th master
+func childName(n *NetConf, ifName string, index int) string {
+	if index == 0 {
+		return ifName
+	}
+	return fmt.Sprintf("%s%s%d", ifName, n.IfNameSuffix, index)
+}
+
+func createIpvlan(conf *NetConf, master string, ifName string, netns ns.NetNS) (*current.Interface, error) {
 	ipvlan := &current.Interface{}
 
 	mode, err := modeFromString(conf.Mode)
 	if err != nil {
 		return nil, err
 	}
+	flag, err := nl.IPVlanFlagFromString(conf.Flags)
+	if err != nil {
+		return nil, err
+	}
 
-	m, err := netlink.LinkByName(conf.Master)
+	m, err := netlink.LinkByName(master)
 	if err != nil {
-		return nil, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
+		return nil, fmt.Errorf("failed to lookup master %q: %v", master, err)
 	}
 
 	// due to kernel bug we have to create with tmpname or it might
@@ -133,7 +231,7 @@ func createIpvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interf
 		Mode: mode,
 	}
 
-	if err := netlink.LinkAdd(mv); err != nil {
+	if err := nl.AddIPVlan(mv, flag); err != nil {
 		return nil, fmt.Errorf("failed to create ipvlan: %v", err)
 	}
 
@@ -144,6 +242,10 @@ func createIpvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interf
 		}
 		ipvlan.Name = ifName
 
+		if err := nl.VerifyIPVlanFlag(ifName, flag); err != nil {
+			return err
+		}
+
 		// Re-fetch ipvlan to get all properties/attributes
 		contIpvlan, err := netlink.LinkByName(ipvlan.Name)
 		if err != nil {
@@ -173,9 +275,15 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
-	ipvlanInterface, err := createIpvlan(n, args.IfName, netns)
-	if err != nil {
-		return err
+	// The master of each ipvlan follows it, so CHECK can find it once
+	// the chain has run
+	var interfaces []*current.Interface
+	for i, master := range n.masters {
+		ipvlanInterface, err := createIpvlan(n, master, childName(n, args.IfName, i), netns)
+		if err != nil {
+			return err
+		}
+		interfaces = append(interfaces, ipvlanInterface, masterInterface(master))
 	}
 
 	var result *current.Result
@@ -200,22 +308,249 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 	}
 	for _, ipc := range result.IPs {
-		// All addresses belong to the ipvlan interface
-		ipc.Interface = current.Int(0)
+		// Addresses belong to the ipvlan on the master they were
+		// allocated on, or to the first one if unknown
+		master := 0
+		if ipc.Interface != nil && *ipc.Interface >= 0 && *ipc.Interface < len(n.masters) {
+			master = *ipc.Interface
+		}
+		ipc.Interface = current.Int(2 * master)
 	}
 
-	result.Interfaces = []*current.Interface{ipvlanInterface}
+	result.Interfaces = interfaces
 
-	err = netns.Do(func(_ ns.NetNS) error {
-		return ipam.ConfigureIface(args.IfName, result)
-	})
+	// In L3S mode no veth is needed for the default route, all traffic
+	// is routed by the host through the master
+	if n.Mode == "l3s" {
+		addDefaultRoute(result)
+	}
+
+	for i, master := range n.masters {
+		ifName := childName(n, args.IfName, i)
+		ips := ipsOf(result, 2*i)
+
+		// Routes only go over the first ipvlan, the others reply from
+		// their own addresses through a table of their own
+		child := *result
+		child.IPs = ips
+		if i > 0 {
+			child.Routes = nil
+		}
+		var paths *lib.RoutePaths
+		if i == 0 && n.routeMTUs.NeedsRoutePaths() {
+			paths, err = aws.InterfaceRoutePaths(master, &n.routeMTUs)
+			if err != nil {
+				return fmt.Errorf("unable to classify routes of %v: %v", master, err)
+			}
+		}
+		err = netns.Do(func(_ ns.NetNS) error {
+			if err := ipam.ConfigureIface(ifName, &child); err != nil {
+				return err
+			}
+			if i > 0 {
+				return addSourceRoutes(ifName, ips, podTableStart+i)
+			}
+			return setRouteMTUs(ifName, child.Routes, &n.routeMTUs, paths)
+		})
+		if err != nil {
+			return err
+		}
+
+		if n.Mode == "l3s" {
+			if err = setupHostRoutes(n, args.ContainerID, master, ips); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Keep the DNS settings of the IPAM result, e.g. the VPC resolver,
+	// unless overridden by the plugin configuration
+	result.DNS = lib.MergeDNS(result.DNS, n.DNS)
+
+	return types.PrintResult(result, cniVersion)
+}
+
+// setRouteMTUs sets the MTU of routes over ifName by the path their
+// traffic takes, as traffic leaving the VPC is limited to lower MTUs than
+// the ENI and path MTU discovery often breaks
+func setRouteMTUs(ifName string, routes []*types.Route, mtus *lib.RouteMTUs, paths *lib.RoutePaths) error {
+	link, err := netlink.LinkByName(ifName)
 	if err != nil {
 		return err
 	}
+	for _, route := range routes {
+		mtu := mtus.For(route.Dst, paths)
+		if mtu == 0 {
+			continue
+		}
+		r := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Gw:        route.GW,
+			MTU:       mtu,
+		}
+		if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+			dst := route.Dst
+			r.Dst = &dst
+		}
+		if err := netlink.RouteReplace(r); err != nil {
+			return fmt.Errorf("failed to set MTU %d on route to %v: %v", mtu, route.Dst.String(), err)
+		}
+	}
+	return nil
+}
 
-	result.DNS = n.DNS
+// ipsOf returns the addresses of the interface at index in result
+func ipsOf(result *current.Result, index int) []*current.IPConfig {
+	var ips []*current.IPConfig
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil && *ipc.Interface == index {
+			ips = append(ips, ipc)
+		}
+	}
+	return ips
+}
 
-	return types.PrintResult(result, cniVersion)
+// addSourceRoutes sends traffic from the IPv4 addresses of an additional
+// ipvlan out of that ipvlan, through the given table in the Pod
+func addSourceRoutes(ifName string, ips []*current.IPConfig, table int) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return err
+	}
+	for _, ipc := range ips {
+		if ipc.Address.IP.To4() == nil || ipc.Gateway == nil {
+			continue
+		}
+		err := netlink.RouteReplace(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Gw:        ipc.Gateway,
+			Table:     table,
+			Flags:     int(netlink.FLAG_ONLINK),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add default route via %v to table %d: %v", ipc.Gateway, table, err)
+		}
+
+		rule := netlink.NewRule()
+		rule.Src = &net.IPNet{IP: ipc.Address.IP, Mask: net.CIDRMask(32, 32)}
+		rule.Table = table
+		rule.Priority = podRulePriority
+		if err := netlink.RuleAdd(rule); err != nil {
+			return fmt.Errorf("failed to add source rule for %v: %v", ipc.Address.IP, err)
+		}
+	}
+	return nil
+}
+
+// addDefaultRoute routes the default over the ipvlan interface via the
+// gateway of the first IPv4 address, unless a default is already present
+func addDefaultRoute(result *current.Result) {
+	for _, route := range result.Routes {
+		if ones, _ := route.Dst.Mask.Size(); route.Dst.Mask != nil && ones == 0 && route.Dst.IP.To4() != nil {
+			return
+		}
+	}
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.To4() != nil && ipc.Gateway != nil {
+			result.Routes = append(result.Routes, &types.Route{
+				Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+				GW:  ipc.Gateway,
+			})
+			return
+		}
+	}
+}
+
+// setupHostRoutes makes the Pod addresses of an L3S ipvlan reachable from
+// the host, so netfilter and kube-proxy see Pod traffic without a veth,
+// and source routes Pod traffic out of its master. The addresses are
+// recorded for the container first, so DEL finds them without the netns.
+func setupHostRoutes(n *NetConf, containerID string, master string, ips []*current.IPConfig) error {
+	mode, err := modeFromString(n.Mode)
+	if err != nil {
+		return err
+	}
+	hostIpvlan, err := nl.EnsureHostIpvlan(master, mode)
+	if err != nil {
+		return err
+	}
+
+	// One table per master, shared by all of its Pods
+	taken, err := nl.RouteTablesInUse()
+	if err != nil {
+		return fmt.Errorf("unable to retrieve IP rules %v", err)
+	}
+	table, err := (&lib.RouteTables{}).Allocate("ipvlan:"+master, n.TableStart, taken)
+	if err != nil {
+		return err
+	}
+
+	var addrs []net.IP
+	for _, ipc := range ips {
+		if ipc.Address.IP.To4() != nil {
+			addrs = append(addrs, ipc.Address.IP)
+		}
+	}
+	if err := (&lib.HostRoutes{}).Add(containerID, addrs); err != nil {
+		return fmt.Errorf("unable to record host routes: %v", err)
+	}
+
+	for _, ipc := range ips {
+		if ipc.Address.IP.To4() == nil {
+			continue
+		}
+		if ipc.Gateway == nil {
+			return fmt.Errorf("no gateway for %v", ipc.Address.IP)
+		}
+		err := nl.AddHostRoutes(hostIpvlan, master, ipc.Address.IP, ipc.Gateway, table, l3sRulePriority)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delHostRoutes removes the host routes recorded for a container, and
+// those of the addresses still in its netns, e.g. from ADDs predating
+// the records
+func delHostRoutes(args *skel.CmdArgs) error {
+	hostRoutes := &lib.HostRoutes{}
+	addrs, err := hostRoutes.Lookup(args.ContainerID)
+	if err != nil {
+		return fmt.Errorf("unable to look up host routes: %v", err)
+	}
+
+	if args.Netns != "" {
+		err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			links, err := netlink.LinkList()
+			if err != nil {
+				return err
+			}
+			for _, link := range links {
+				if link.Type() != "ipvlan" {
+					continue
+				}
+				linkAddrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+				if err != nil {
+					return err
+				}
+				for _, addr := range linkAddrs {
+					addrs = append(addrs, addr.IP)
+				}
+			}
+			return nil
+		})
+		if _, ok := err.(ns.NSPathNotExistErr); !ok && err != nil {
+			return fmt.Errorf("unable to list addresses in %v: %v", args.Netns, err)
+		}
+	}
+
+	for _, addr := range addrs {
+		if err := nl.DelHostRoutes(addr, l3sRulePriority); err != nil {
+			return err
+		}
+	}
+	return hostRoutes.Remove(args.ContainerID)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -224,6 +559,14 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
+	// Remove the host routes of L3S Pods, recorded at ADD as the netns
+	// may already be gone
+	if n.Mode == "l3s" {
+		if err := delHostRoutes(args); err != nil {
+			return err
+		}
+	}
+
 	// On chained invocation, IPAM block can be empty
 	if n.IPAM.Type != "" {
 		err = ipam.ExecDel(n.IPAM.Type, args.StdinData)
@@ -257,7 +600,128 @@ func cmdDel(args *skel.CmdArgs) error {
 
 // cmdCheck is called for CHECK requests
 func cmdCheck(args *skel.CmdArgs) error {
-	// TODO: implement this
+	n, _, err := loadConf(args.StdinData, cniCheck)
+	if err != nil {
+		return err
+	}
+
+	if n.IPAM.Type != "" {
+		err = ipam.ExecCheck(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	result := n.PrevResult
+
+	// Find the ipvlans in the container, each followed by its master
+	type child struct {
+		name   string
+		index  int
+		master string
+	}
+	var children []child
+	for i, iface := range result.Interfaces {
+		if iface.Sandbox != args.Netns || (iface.Name != args.IfName && !strings.HasPrefix(iface.Name, args.IfName+n.IfNameSuffix)) {
+			continue
+		}
+		if i+1 >= len(result.Interfaces) || result.Interfaces[i+1].Sandbox != "" {
+			continue
+		}
+		master := result.Interfaces[i+1].Name
+		if iface.Name == args.IfName && n.Master != "" {
+			master = n.Master
+		}
+		children = append(children, child{name: iface.Name, index: i, master: master})
+	}
+	if len(children) == 0 || children[0].name != args.IfName {
+		return fmt.Errorf("interface %q in netns %q not found in prevResult", args.IfName, args.Netns)
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	for _, c := range children {
+		m, err := netlink.LinkByName(c.master)
+		if err != nil {
+			return fmt.Errorf("failed to lookup master %q: %v", c.master, err)
+		}
+
+		// Only validate the addresses owned by the ipvlan
+		var ips []*current.IPConfig
+		for _, ipc := range result.IPs {
+			if ipc.Interface != nil && *ipc.Interface >= 0 && *ipc.Interface < len(result.Interfaces) &&
+				*ipc.Interface != c.index {
+				continue
+			}
+			ips = append(ips, ipc)
+		}
+
+		err = netns.Do(func(_ ns.NetNS) error {
+			if err := validateIpvlan(n, c.name, m.Attrs().Index); err != nil {
+				return err
+			}
+			return ip.ValidateExpectedInterfaceIPs(c.name, ips)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		return ip.ValidateExpectedRoute(result.Routes)
+	})
+}
+
+// validateIpvlan checks that ifName is an ipvlan on the master with index
+// parentIndex, configured as requested
+func validateIpvlan(n *NetConf, ifName string, parentIndex int) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("container interface %q not found: %v", ifName, err)
+	}
+
+	ipvlan, ok := link.(*netlink.IPVlan)
+	if !ok {
+		return fmt.Errorf("container interface %q is a %v, not an ipvlan", ifName, link.Type())
+	}
+
+	// A detached ENI removes its ipvlans, while a master recreated
+	// under the same name gets a new index
+	if ipvlan.Attrs().ParentIndex != parentIndex {
+		return fmt.Errorf("container interface %q is not on its master (index %d, expected %d)",
+			ifName, ipvlan.Attrs().ParentIndex, parentIndex)
+	}
+
+	mode, err := modeFromString(n.Mode)
+	if err != nil {
+		return err
+	}
+	if ipvlan.Mode != mode {
+		return fmt.Errorf("container interface %q has mode %v, expected %v", ifName, ipvlan.Mode, mode)
+	}
+
+	flag, err := nl.IPVlanFlagFromString(n.Flags)
+	if err != nil {
+		return err
+	}
+	actual, err := nl.GetIPVlanFlag(ipvlan)
+	if err != nil {
+		return err
+	}
+	if actual != flag {
+		return fmt.Errorf("container interface %q has flags %v, expected %v", ifName, actual, flag)
+	}
+
+	if n.MTU != 0 && ipvlan.Attrs().MTU != n.MTU {
+		return fmt.Errorf("container interface %q has MTU %d, expected %d", ifName, ipvlan.Attrs().MTU, n.MTU)
+	}
 	return nil
 }
 
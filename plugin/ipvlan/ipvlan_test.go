@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLoadConfFlags(t *testing.T) {
+	cases := []struct {
+		Conf  string
+		Valid bool
+	}{
+		{`{"master": "eth1", "mode": "l2"}`, true},
+		{`{"master": "eth1", "mode": "l2", "flags": "private"}`, true},
+		{`{"master": "eth1", "mode": "l3", "flags": "vepa"}`, true},
+		{`{"master": "eth1", "mode": "l2", "flags": "isolated"}`, false},
+		// the host side ipvlan of l3s mode must reach Pods directly
+		{`{"master": "eth1", "mode": "l3s", "flags": "private"}`, false},
+		{`{"master": "eth1", "mode": "l3s", "flags": "bridge"}`, true},
+	}
+
+	for _, c := range cases {
+		_, _, err := loadConf([]byte(c.Conf), cniAdd)
+		if c.Valid && err != nil {
+			t.Errorf("Valid config %v rejected: %v", c.Conf, err)
+		}
+		if !c.Valid && err == nil {
+			t.Errorf("Invalid config %v accepted", c.Conf)
+		}
+	}
+}
+
+func TestLoadConfCheck(t *testing.T) {
+	// After the whole chain ran, prevResult holds more than the master
+	conf := `{
+		"cniVersion": "0.4.0",
+		"mode": "l2",
+		"prevResult": {
+			"cniVersion": "0.4.0",
+			"interfaces": [
+				{"name": "eth0", "sandbox": "/var/run/netns/test"},
+				{"name": "eth1"},
+				{"name": "veth1234"}
+			],
+			"ips": [{"version": "4", "address": "10.0.0.5/24", "gateway": "10.0.0.1", "interface": 0}]
+		}
+	}`
+
+	if _, _, err := loadConf([]byte(conf), cniAdd); err == nil {
+		t.Errorf("Container interface accepted as master for ADD")
+	}
+
+	n, _, err := loadConf([]byte(conf), cniCheck)
+	if err != nil {
+		t.Fatalf("Error returned %v", err)
+	}
+	if n.Master != "" || len(n.PrevResult.Interfaces) != 3 {
+		t.Errorf("Invalid config loaded %+v", n)
+	}
+}
+
+func TestLoadConfMasters(t *testing.T) {
+	conf := `{
+		"cniVersion": "0.4.0",
+		"mode": "l2",
+		"prevResult": {
+			"cniVersion": "0.4.0",
+			"interfaces": [{"name": "eth1"}, {"name": "eth2"}],
+			"ips": [
+				{"version": "4", "address": "10.0.0.5/24", "gateway": "10.0.0.1", "interface": 0},
+				{"version": "4", "address": "10.0.1.5/24", "gateway": "10.0.1.1", "interface": 1}
+			]
+		}
+	}`
+
+	n, _, err := loadConf([]byte(conf), cniAdd)
+	if err != nil {
+		t.Fatalf("Error returned %v", err)
+	}
+	if len(n.masters) != 2 || n.masters[0] != "eth1" || n.masters[1] != "eth2" || n.Master != "eth1" {
+		t.Errorf("Invalid masters %v", n.masters)
+	}
+	if name := childName(n, "eth0", 0); name != "eth0" {
+		t.Errorf("Invalid first ipvlan name %v", name)
+	}
+	if name := childName(n, "eth0", 1); name != "eth0-1" {
+		t.Errorf("Invalid second ipvlan name %v", name)
+	}
+}
@@ -19,13 +19,8 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"math"
-	"math/rand"
 	"net"
-	"os"
-	"sort"
 	"strconv"
-	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -37,17 +32,18 @@ import (
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/j-keck/arping"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
 	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-// constants for full jitter backoff in milliseconds, and for nodeport marks
+// constants for nodeport marks and policy routing
 const (
-	maxSleep             = 10000 // 10.00s
-	baseSleep            = 20    //  0.02
 	RPFilterTemplate     = "net.ipv4.conf.%s.rp_filter"
 	podRulePriority      = 1024
 	nodePortRulePriority = 512
+	instanceMetadataCIDR = "169.254.169.254/32"
 )
 
 // PluginConf is whatever you expect your configuration json to be. This is whatever
@@ -66,13 +62,94 @@ type PluginConf struct {
 	RawPrevResult *map[string]interface{} `json:"prevResult"`
 	PrevResult    *current.Result         `json:"-"`
 
-	IPMasq             bool   `json:"ipMasq"`
-	HostInterface      string `json:"hostInterface"`
-	ContainerInterface string `json:"containerInterface"`
-	MTU                int    `json:"mtu"`
-	TableStart         int    `json:"routeTableStart"`
-	NodePortMark       int    `json:"nodePortMark"`
-	NodePorts          string `json:"nodePorts"`
+	IPMasq               bool   `json:"ipMasq"`
+	HostInterface        string `json:"hostInterface"`
+	ContainerInterface   string `json:"containerInterface"`
+	MTU                  int    `json:"mtu"`
+	TableStart           int    `json:"routeTableStart"`
+	NodePortMark         int    `json:"nodePortMark"`
+	NodePorts            string `json:"nodePorts"`
+	IPv6DefaultViaIpvlan bool   `json:"ipv6DefaultViaIpvlan"`
+
+	NonMasqueradeCIDRs []string `json:"nonMasqueradeCidrs"`
+	SNATAddress        string   `json:"snatAddress"`
+	NamespaceEgressIPs bool     `json:"namespaceEgressIps"`
+	ServiceCIDRs       []string `json:"serviceCidrs"`
+	DefaultRouteMTU    int      `json:"defaultRouteMtu"`
+	HostRoutes         []string `json:"hostRoutes"`
+	StateDir           string   `json:"stateDir"`
+
+	// Pods can't reach the instance metadata service with
+	// BlockInstanceMetadata, unless allow-listed through the CNI args
+	// convention, e.g. by Multus from a Pod annotation, or by namespace
+	// in InstanceMetadataNamespaces. Requests are redirected to a
+	// metadata proxy on InstanceMetadataProxyPort of the host interface
+	// if set.
+	BlockInstanceMetadata      bool     `json:"blockInstanceMetadata"`
+	InstanceMetadataProxyPort  int      `json:"instanceMetadataProxyPort"`
+	InstanceMetadataNamespaces []string `json:"instanceMetadataNamespaces"`
+	Args                       *struct {
+		CNI struct {
+			AllowInstanceMetadata bool `json:"allowInstanceMetadata"`
+		} `json:"cni"`
+	} `json:"args"`
+
+	nonMasqueradeNets []*net.IPNet
+	serviceNets       []*net.IPNet
+	hostNets          []*net.IPNet
+	snatIP            net.IP
+}
+
+// K8sArgs are the arguments kubelet passes to CNI plugins in CNI_ARGS
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE          types.UnmarshallableString // nolint: golint
+	K8S_POD_NAME               types.UnmarshallableString // nolint: golint
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString // nolint: golint
+}
+
+// namespaceSNATAddress returns the egress IP assigned to the Pod's
+// namespace by egress-ip-sync, falling back to the configured snatAddress
+func namespaceSNATAddress(conf *PluginConf, cniArgs string) (net.IP, error) {
+	if !conf.NamespaceEgressIPs {
+		return conf.snatIP, nil
+	}
+	k8sArgs := K8sArgs{}
+	if err := types.LoadArgs(cniArgs, &k8sArgs); err != nil {
+		return nil, err
+	}
+	namespace := string(k8sArgs.K8S_POD_NAMESPACE)
+	if namespace == "" {
+		return conf.snatIP, nil
+	}
+	egress, err := (&lib.EgressIPs{}).Get(namespace)
+	if err != nil {
+		return nil, err
+	}
+	if egress == nil || egress.Draining {
+		return conf.snatIP, nil
+	}
+	return egress.IP, nil
+}
+
+// blocksInstanceMetadata returns whether the Pod is denied access to the
+// instance metadata service. Kubelet doesn't pass CNI args, so Pods are
+// also allowed by the namespace it passes in cniArgs.
+func (conf *PluginConf) blocksInstanceMetadata(cniArgs string) bool {
+	if !conf.BlockInstanceMetadata || (conf.Args != nil && conf.Args.CNI.AllowInstanceMetadata) {
+		return false
+	}
+	k8sArgs := K8sArgs{}
+	if err := types.LoadArgs(cniArgs, &k8sArgs); err != nil {
+		return true
+	}
+	namespace := string(k8sArgs.K8S_POD_NAMESPACE)
+	for _, allowed := range conf.InstanceMetadataNamespaces {
+		if namespace != "" && namespace == allowed {
+			return false
+		}
+	}
+	return true
 }
 
 // parseConfig parses the supplied configuration (and prevResult) from stdin.
@@ -82,6 +159,7 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 	if err := json.Unmarshal(stdin, &conf); err != nil {
 		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
 	}
+	lib.SetStatePath(conf.StateDir)
 
 	// Parse previous result.
 	if conf.RawPrevResult != nil {
@@ -114,6 +192,10 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 		conf.MTU = baseMtu
 	}
 
+	if conf.DefaultRouteMTU != 0 && (conf.DefaultRouteMTU < 576 || conf.DefaultRouteMTU > conf.MTU) {
+		return nil, fmt.Errorf("invalid defaultRouteMtu %d", conf.DefaultRouteMTU)
+	}
+
 	if conf.ContainerInterface == "" {
 		return nil, fmt.Errorf("containerInterface must be specified")
 	}
@@ -131,6 +213,41 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 		conf.TableStart = 256
 	}
 
+	for _, cidr := range conf.NonMasqueradeCIDRs {
+		_, parsed, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse nonMasqueradeCidrs element %v", err)
+		}
+		conf.nonMasqueradeNets = append(conf.nonMasqueradeNets, parsed)
+	}
+
+	for _, cidr := range conf.ServiceCIDRs {
+		_, parsed, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse serviceCidrs element %v", err)
+		}
+		conf.serviceNets = append(conf.serviceNets, parsed)
+	}
+
+	for _, cidr := range conf.HostRoutes {
+		_, parsed, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse hostRoutes element %v", err)
+		}
+		conf.hostNets = append(conf.hostNets, parsed)
+	}
+
+	if conf.InstanceMetadataProxyPort < 0 || conf.InstanceMetadataProxyPort > 65535 {
+		return nil, fmt.Errorf("invalid instanceMetadataProxyPort %d", conf.InstanceMetadataProxyPort)
+	}
+
+	if conf.SNATAddress != "" {
+		conf.snatIP = net.ParseIP(conf.SNATAddress)
+		if conf.snatIP == nil {
+			return nil, fmt.Errorf("invalid snatAddress %q", conf.SNATAddress)
+		}
+	}
+
 	return &conf, nil
 }
 
@@ -150,8 +267,59 @@ func enableForwarding(ipv4 bool, ipv6 bool) error {
 	return nil
 }
 
-func setupSNAT(ifName string, comment string) error {
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+// iptablesProtocol returns the iptables protocol handling an address family
+func iptablesProtocol(ipv6 bool) iptables.Protocol {
+	if ipv6 {
+		return iptables.ProtocolIPv6
+	}
+	return iptables.ProtocolIPv4
+}
+
+// hostMask returns a mask covering only addr
+func hostMask(addr net.IP) net.IPMask {
+	if addr.To4() != nil {
+		return net.CIDRMask(32, 32)
+	}
+	return net.CIDRMask(128, 128)
+}
+
+// firstGlobalAddr returns the first address of the requested family which
+// is not link-local, or nil if there is none
+func firstGlobalAddr(addrs []netlink.Addr, ipv6 bool) net.IP {
+	for _, addr := range addrs {
+		if (addr.IP.To4() == nil) != ipv6 || addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		return addr.IP
+	}
+	return nil
+}
+
+// hasDefaultRoute returns whether the previous result already routes the
+// default of a family, e.g. over the ipvlan interface of a Pod with an
+// Elastic IP
+func hasDefaultRoute(pr *current.Result, ipv6 bool) bool {
+	for _, route := range pr.Routes {
+		ones, _ := route.Dst.Mask.Size()
+		if route.Dst.Mask != nil && ones == 0 && (route.Dst.IP.To4() == nil) == ipv6 {
+			return true
+		}
+	}
+	return false
+}
+
+// announceAddr advertises ownership of addr over iface, using a gratuitous
+// ARP for IPv4 and an unsolicited neighbor advertisement for IPv6
+func announceAddr(addr net.IP, iface net.Interface) {
+	if addr.To4() != nil {
+		_ = arping.GratuitousArpOverIface(addr, iface)
+	} else if !addr.IsLinkLocalUnicast() {
+		_ = nl.SendUnsolicitedNeighborAdvertisement(addr, iface)
+	}
+}
+
+func setupSNAT(ifName string, comment string, proto iptables.Protocol) error {
+	ipt, err := iptables.NewWithProtocol(proto)
 	if err != nil {
 		return fmt.Errorf("failed to locate iptables: %v", err)
 	}
@@ -163,92 +331,245 @@ func setupSNAT(ifName string, comment string) error {
 	return ipt.AppendUnique("nat", "POSTROUTING", rulespec...)
 }
 
-func findFreeTable(start int) (int, error) {
-	allocatedTableIDs := make(map[int]bool)
-	// combine V4 and V6 tables
-	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
-		rules, err := netlink.RuleList(family)
-		if err != nil {
-			return -1, err
+// setupIPMasq installs iptables rules to masquerade traffic coming from
+// the Pod address ipn, or to SNAT it to snatIP if one of the same family
+// is given. Traffic to the Pod itself, multicast and nonMasq destinations
+// is left untouched. The rules live in a chain per container, and are
+// laid out so that ip.TeardownIPMasq removes them.
+func setupIPMasq(ipn *net.IPNet, chain string, comment string, nonMasq []*net.IPNet, snatIP net.IP) error {
+	ipv6 := ipn.IP.To4() == nil
+	multicastNet := "224.0.0.0/4"
+	if ipv6 {
+		multicastNet = "ff00::/8"
+	}
+
+	ipt, err := iptables.NewWithProtocol(iptablesProtocol(ipv6))
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	if err := utils.EnsureChain(ipt, "nat", chain); err != nil {
+		return err
+	}
+
+	// Packets to this network should not be touched
+	if err := ipt.AppendUnique("nat", chain, "-d", ipn.String(), "-j", "ACCEPT", "-m", "comment", "--comment", comment); err != nil {
+		return err
+	}
+
+	// Nor should packets to excluded destinations, which see the Pod IP
+	for _, dst := range nonMasq {
+		if (dst.IP.To4() == nil) != ipv6 {
+			continue
 		}
-		for _, rule := range rules {
-			allocatedTableIDs[rule.Table] = true
+		if err := ipt.AppendUnique("nat", chain, "-d", dst.String(), "-j", "ACCEPT", "-m", "comment", "--comment", comment); err != nil {
+			return err
 		}
 	}
-	// find first slot that's available for both V4 and V6 usage
-	for i := start; i < math.MaxUint32; i++ {
-		if !allocatedTableIDs[i] {
-			return i, nil
+
+	// Don't masquerade multicast - pods should be able to talk to other pods
+	// on the local network via multicast.
+	target := []string{"-j", "MASQUERADE"}
+	if snatIP != nil && (snatIP.To4() == nil) == ipv6 {
+		target = []string{"-j", "SNAT", "--to-source", snatIP.String()}
+	}
+	rulespec := append([]string{"!", "-d", multicastNet}, target...)
+	rulespec = append(rulespec, "-m", "comment", "--comment", comment)
+	if err := ipt.AppendUnique("nat", chain, rulespec...); err != nil {
+		return err
+	}
+
+	// Packets from the specific IP of this network will hit the chain
+	return ipt.AppendUnique("nat", "POSTROUTING", "-s", ipn.IP.String(), "-j", chain, "-m", "comment", "--comment", comment)
+}
+
+// natRules are the iptables operations teardownIPMasq needs
+type natRules interface {
+	Delete(table, chain string, rulespec ...string) error
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+}
+
+// teardownIPMasq removes the rules setupIPMasq installed for the Pod
+// addresses ips of one family. All addresses of a container share its
+// chain, so every jump is deleted before the chain.
+func teardownIPMasq(ipt natRules, ips []net.IP, chain string, comment string) error {
+	for _, addr := range ips {
+		// rules of older versions match the address with a prefix length
+		ipn := &net.IPNet{IP: addr, Mask: hostMask(addr)}
+		for _, src := range []string{addr.String(), ipn.String()} {
+			err := ipt.Delete("nat", "POSTROUTING", "-s", src, "-j", chain, "-m", "comment", "--comment", comment)
+			if err != nil && !isNotExist(err) {
+				return err
+			}
 		}
 	}
-	return -1, fmt.Errorf("failed to find free route table")
+	if err := ipt.ClearChain("nat", chain); err != nil && !isNotExist(err) {
+		return err
+	}
+	if err := ipt.DeleteChain("nat", chain); err != nil && !isNotExist(err) {
+		return err
+	}
+	return nil
 }
 
-func addPolicyRules(veth *net.Interface, ipc *current.IPConfig, routes []*types.Route, tableStart int) error {
-	table := -1
+// isNotExist returns whether err is iptables failing on a missing rule
+// or chain
+func isNotExist(err error) bool {
+	e, ok := err.(*iptables.Error)
+	return ok && e.IsNotExist()
+}
 
-	// depend on netlink atomicity to win races for table slots on initial route add
-	sort.Slice(routes, func(i, j int) bool {
-		return routes[i].Dst.String() < routes[j].Dst.String()
-	})
+func addPolicyRules(veth *net.Interface, ips []*current.IPConfig, routes []*types.Route, hostNets []*net.IPNet, table int) error {
+	// routes are sent back to the Pod via its first address of the same family
+	gateways := make(map[bool]net.IP)
+	for _, ipc := range ips {
+		ipv6 := ipc.Address.IP.To4() == nil
+		if gateways[ipv6] == nil {
+			gateways[ipv6] = ipc.Address.IP
+		}
+	}
 
-	// try 10 times to write to an empty table slot
-	for i := 0; i < 10 && table == -1; i++ {
-		var err error
-		// jitter looking for an initial free table slot
-		table, err = findFreeTable(tableStart + rand.Intn(1000))
+	// add routes to the policy routing table
+	for _, route := range routes {
+		gw := gateways[route.Dst.IP.To4() == nil]
+		if gw == nil {
+			// the Pod has no address of this family
+			continue
+		}
+		err := netlink.RouteAdd(&netlink.Route{
+			LinkIndex: veth.Index,
+			Dst:       &route.Dst,
+			Gw:        gw,
+			Table:     table,
+		})
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to add route %v to table %d: %v", route.Dst, table, err)
 		}
+	}
 
-		// add routes to the policy routing table
-		for _, route := range routes {
-			err := netlink.RouteAdd(&netlink.Route{
-				LinkIndex: veth.Index,
-				Dst:       &route.Dst,
-				Gw:        ipc.Address.IP,
-				Table:     table,
-			})
-			if err != nil {
-				table = -1
-				break
-			}
+	// traffic to host routes falls through to the main table, even when
+	// a Pod route covers it, to reach local addresses such as node-local
+	// DNS. Replies return to the Pod over its main table host route.
+	for _, dst := range hostNets {
+		if gateways[dst.IP.To4() == nil] == nil {
+			continue
 		}
-
-		if table == -1 {
-			// failed to add routes so sleep and try again on a different table
-			wait := time.Duration(rand.Intn(int(math.Min(maxSleep,
-				baseSleep*math.Pow(2, float64(i)))))) * time.Millisecond
-			fmt.Fprintf(os.Stderr, "route table collision, retrying in %v\n", wait)
-			time.Sleep(wait)
+		err := netlink.RouteAdd(&netlink.Route{
+			Dst:   dst,
+			Table: table,
+			Type:  unix.RTN_THROW,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add throw route %v to table %d: %v", dst, table, err)
 		}
 	}
 
-	// ensure we have a route table selected
-	if table == -1 {
-		return fmt.Errorf("failed to add routes to a free table")
+	// add policy route for traffic originating from a Pod, per family
+	for _, ipv6 := range []bool{false, true} {
+		if gateways[ipv6] == nil {
+			continue
+		}
+		rule := netlink.NewRule()
+		rule.IifName = veth.Name
+		rule.Table = table
+		rule.Priority = podRulePriority
+		if ipv6 {
+			rule.Family = netlink.FAMILY_V6
+		}
+
+		err := netlink.RuleAdd(rule)
+		if err != nil {
+			return fmt.Errorf("failed to add policy rule %v: %v", rule, err)
+		}
 	}
 
-	// add policy route for traffic originating from a Pod
-	rule := netlink.NewRule()
-	rule.IifName = veth.Name
-	rule.Table = table
-	rule.Priority = podRulePriority
+	return nil
+}
 
-	err := netlink.RuleAdd(rule)
+// setupMetadataBlock rejects traffic from the Pod behind vethName to the
+// instance metadata service, or redirects its TCP traffic to the metadata
+// proxy at proxyAddr if given. The rules live in chains per container so
+// that teardownMetadataBlock removes them.
+func setupMetadataBlock(vethName string, chain string, comment string, proxyAddr string) error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	if err != nil {
-		return fmt.Errorf("failed to add policy rule %v: %v", rule, err)
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	targets := map[string][]string{
+		"filter": {"-i", vethName, "-j", "REJECT"},
+	}
+	if proxyAddr != "" {
+		targets["nat"] = []string{"-i", vethName, "-p", "tcp", "-j", "DNAT", "--to-destination", proxyAddr}
 	}
 
+	for table, target := range targets {
+		if err := utils.EnsureChain(ipt, table, chain); err != nil {
+			return err
+		}
+		if err := ipt.AppendUnique(table, chain, append(target, "-m", "comment", "--comment", comment)...); err != nil {
+			return err
+		}
+
+		// Jump first, ahead of rules accepting forwarded Pod traffic
+		jump := []string{"-d", instanceMetadataCIDR, "-j", chain, "-m", "comment", "--comment", comment}
+		parent := metadataParentChain(table)
+		exists, err := ipt.Exists(table, parent, jump...)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := ipt.Insert(table, parent, 1, jump...); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-func setupNodePortRule(ifName string, nodePorts string, nodePortMark int) error {
+// teardownMetadataBlock removes the rules of setupMetadataBlock
+func teardownMetadataBlock(chain string, comment string) error {
 	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	if err != nil {
 		return fmt.Errorf("failed to locate iptables: %v", err)
 	}
 
+	for _, table := range []string{"filter", "nat"} {
+		jump := []string{"-d", instanceMetadataCIDR, "-j", chain, "-m", "comment", "--comment", comment}
+		if err := utils.DeleteRule(ipt, table, metadataParentChain(table), jump...); err != nil {
+			return err
+		}
+		exists, err := utils.ChainExists(ipt, table, chain)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err := ipt.ClearChain(table, chain); err != nil {
+			return err
+		}
+		if err := utils.DeleteChain(ipt, table, chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func metadataParentChain(table string) string {
+	if table == "nat" {
+		return "PREROUTING"
+	}
+	return "FORWARD"
+}
+
+func setupNodePortRule(ifName string, nodePorts string, nodePortMark int, ipv6 bool) error {
+	ipt, err := iptables.NewWithProtocol(iptablesProtocol(ipv6))
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
 	// Create iptables rules to ensure that nodeport traffic is marked
 	if err := ipt.AppendUnique("mangle", "PREROUTING", "-i", ifName, "-p", "tcp", "--dport", nodePorts, "-j", "CONNMARK", "--set-mark", strconv.Itoa(nodePortMark), "-m", "comment", "--comment", "NodePort Mark"); err != nil {
 		return err
@@ -260,10 +581,13 @@ func setupNodePortRule(ifName string, nodePorts string, nodePortMark int) error
 		return err
 	}
 
-	// Use loose RP filter on host interface (RP filter does not take mark-based rules into account)
-	_, err = sysctl.Sysctl(fmt.Sprintf(RPFilterTemplate, ifName), "2")
-	if err != nil {
-		return fmt.Errorf("failed to set RP filter to loose for interface %q: %v", ifName, err)
+	// Use loose RP filter on host interface (RP filter does not take mark-based rules into account).
+	// IPv6 has no RP filter sysctl.
+	if !ipv6 {
+		_, err = sysctl.Sysctl(fmt.Sprintf(RPFilterTemplate, ifName), "2")
+		if err != nil {
+			return fmt.Errorf("failed to set RP filter to loose for interface %q: %v", ifName, err)
+		}
 	}
 
 	// add policy route for traffic from marked as nodeport
@@ -271,9 +595,14 @@ func setupNodePortRule(ifName string, nodePorts string, nodePortMark int) error
 	rule.Mark = nodePortMark
 	rule.Table = 254 // main table
 	rule.Priority = nodePortRulePriority
+	family := netlink.FAMILY_V4
+	if ipv6 {
+		family = netlink.FAMILY_V6
+		rule.Family = family
+	}
 
 	exists := false
-	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	rules, err := netlink.RuleList(family)
 	if err != nil {
 		return fmt.Errorf("Unable to retrieve IP rules %v", err)
 	}
@@ -294,12 +623,13 @@ func setupNodePortRule(ifName string, nodePorts string, nodePortMark int) error
 	return nil
 }
 
-func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, hostAddrs []netlink.Addr, masq, containerIPV4, containerIPV6 bool, k8sIfName string, pr *current.Result) (*current.Interface, *current.Interface, error) {
+func setupContainerVeth(netns ns.NetNS, conf *PluginConf, hostAddrs []netlink.Addr, containerIPV4, containerIPV6 bool, k8sIfName string, pr *current.Result) (*current.Interface, *current.Interface, error) {
 	hostInterface := &current.Interface{}
 	containerInterface := &current.Interface{}
+	ifName := conf.ContainerInterface
 
 	err := netns.Do(func(hostNS ns.NetNS) error {
-		hostVeth, contVeth0, err := ip.SetupVeth(ifName, mtu, hostNS)
+		hostVeth, contVeth0, err := ip.SetupVeth(ifName, conf.MTU, hostNS)
 		if err != nil {
 			return err
 		}
@@ -318,16 +648,21 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, hostAddrs []netl
 			return fmt.Errorf("failed to look up %q: %v", ifName, err)
 		}
 
-		if masq {
+		if conf.IPMasq {
 			// enable forwarding and SNATing for traffic rerouted from kube-proxy
 			err := enableForwarding(containerIPV4, containerIPV6)
 			if err != nil {
 				return err
 			}
 
-			err = setupSNAT(k8sIfName, "kube-proxy SNAT")
-			if err != nil {
-				return fmt.Errorf("failed to enable SNAT on %q: %v", k8sIfName, err)
+			for _, ipv6 := range []bool{false, true} {
+				if (ipv6 && !containerIPV6) || (!ipv6 && !containerIPV4) {
+					continue
+				}
+				err = setupSNAT(k8sIfName, "kube-proxy SNAT", iptablesProtocol(ipv6))
+				if err != nil {
+					return fmt.Errorf("failed to enable SNAT on %q: %v", k8sIfName, err)
+				}
 			}
 		}
 
@@ -352,24 +687,79 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, hostAddrs []netl
 			}
 		}
 
-		// add a default gateway pointed at the first hostAddr
-		err = netlink.RouteAdd(&netlink.Route{
-			LinkIndex: contVeth.Index,
-			Scope:     netlink.SCOPE_UNIVERSE,
-			Dst:       nil,
-			Gw:        hostAddrs[0].IP,
-		})
-		if err != nil {
-			return fmt.Errorf("failed to add default route %v: %v", hostAddrs[0].IP, err)
+		// add the configured host routes, e.g. to link-local or dummy
+		// interface addresses of node-local services, on dev contVeth
+		for _, dst := range conf.hostNets {
+			if (dst.IP.To4() == nil && !containerIPV6) || (dst.IP.To4() != nil && !containerIPV4) {
+				continue
+			}
+			err := netlink.RouteAdd(&netlink.Route{
+				LinkIndex: contVeth.Index,
+				Scope:     netlink.SCOPE_LINK,
+				Dst:       dst,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to add host route dst %v: %v", dst, err)
+			}
 		}
 
-		// Send a gratuitous arp for all borrowed v4 addresses
-		for _, ipc := range pr.IPs {
-			if ipc.Version == "4" {
-				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
+		// add a default gateway pointed at the first hostAddr, unless
+		// the Pod egresses over its ipvlan interface. Services then
+		// still need to reach kube-proxy on the host.
+		if containerIPV4 {
+			gw := firstGlobalAddr(hostAddrs, false)
+			if gw == nil {
+				return fmt.Errorf("no IPv4 address on %q for the default route", conf.HostInterface)
+			}
+			if !hasDefaultRoute(pr, false) {
+				err = netlink.RouteAdd(&netlink.Route{
+					LinkIndex: contVeth.Index,
+					Scope:     netlink.SCOPE_UNIVERSE,
+					Dst:       nil,
+					Gw:        gw,
+					MTU:       conf.DefaultRouteMTU,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to add default route %v: %v", gw, err)
+				}
+			}
+			for _, dst := range conf.serviceNets {
+				if dst.IP.To4() == nil {
+					continue
+				}
+				err = netlink.RouteAdd(&netlink.Route{
+					LinkIndex: contVeth.Index,
+					Scope:     netlink.SCOPE_UNIVERSE,
+					Dst:       dst,
+					Gw:        gw,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to add service route %v: %v", dst, err)
+				}
 			}
 		}
 
+		// IPv6 defaults over the veth as well, unless the Pod egresses
+		// through the ipvlan interface (e.g. via an egress-only internet
+		// gateway). A default installed by the ipvlan plugin is replaced.
+		if gw := firstGlobalAddr(hostAddrs, true); containerIPV6 && !conf.IPv6DefaultViaIpvlan && gw != nil {
+			err = netlink.RouteReplace(&netlink.Route{
+				LinkIndex: contVeth.Index,
+				Scope:     netlink.SCOPE_UNIVERSE,
+				Dst:       nil,
+				Gw:        gw,
+				MTU:       conf.DefaultRouteMTU,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to add default route %v: %v", gw, err)
+			}
+		}
+
+		// Announce all borrowed addresses
+		for _, ipc := range pr.IPs {
+			announceAddr(ipc.Address.IP, *contVeth)
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -378,7 +768,7 @@ func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, hostAddrs []netl
 	return hostInterface, containerInterface, nil
 }
 
-func setupHostVeth(vethName string, hostAddrs []netlink.Addr, masq bool, tableStart int, result *current.Result) error {
+func setupHostVeth(vethName string, hostAddrs []netlink.Addr, hostNets []*net.IPNet, masq bool, table int, result *current.Result) error {
 	// no IPs to route
 	if len(result.IPs) == 0 {
 		return nil
@@ -412,16 +802,14 @@ func setupHostVeth(vethName string, hostAddrs []netlink.Addr, masq bool, tableSt
 	}
 
 	// add policy rules for traffic coming in from Pods and destined for the VPC
-	err = addPolicyRules(veth, result.IPs[0], result.Routes, tableStart)
+	err = addPolicyRules(veth, result.IPs, result.Routes, hostNets, table)
 	if err != nil {
 		return fmt.Errorf("failed to add policy rules: %v", err)
 	}
 
-	// Send a gratuitous arp for all borrowed v4 addresses
+	// Announce all borrowed addresses
 	for _, ipc := range hostAddrs {
-		if ipc.IP.To4() != nil {
-			_ = arping.GratuitousArpOverIface(ipc.IP, *veth)
-		}
+		announceAddr(ipc.IP, *veth)
 	}
 
 	return nil
@@ -491,13 +879,34 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 	}
 
-	hostInterface, _, err := setupContainerVeth(netns, conf.ContainerInterface, conf.MTU,
-		hostAddrs, conf.IPMasq, containerIPV4, containerIPV6, args.IfName, conf.PrevResult)
+	hostInterface, _, err := setupContainerVeth(netns, conf, hostAddrs,
+		containerIPV4, containerIPV6, args.IfName, conf.PrevResult)
 	if err != nil {
 		return err
 	}
 
-	if err = setupHostVeth(hostInterface.Name, hostAddrs, conf.IPMasq, conf.TableStart, conf.PrevResult); err != nil {
+	// Allocate a policy routing table for this container, skipping any
+	// tables referenced by rules we did not allocate
+	taken, err := nl.RouteTablesInUse()
+	if err != nil {
+		return fmt.Errorf("unable to retrieve IP rules %v", err)
+	}
+	tables := &lib.RouteTables{}
+	table, err := tables.Allocate(args.ContainerID, conf.TableStart, taken)
+	if err != nil {
+		return err
+	}
+	// A failed ADD may never get a DEL, so give the table back on any
+	// failure from here on
+	added := false
+	defer func() {
+		if !added {
+			_ = nl.FlushRouteTable(table)
+			_ = tables.Release(args.ContainerID)
+		}
+	}()
+
+	if err = setupHostVeth(hostInterface.Name, hostAddrs, conf.hostNets, conf.IPMasq, table, conf.PrevResult); err != nil {
 		return err
 	}
 
@@ -507,22 +916,51 @@ func cmdAdd(args *skel.CmdArgs) error {
 			return err
 		}
 
+		snatIP, err := namespaceSNATAddress(conf, args.Args)
+		if err != nil {
+			return fmt.Errorf("unable to find egress IP for namespace: %v", err)
+		}
+
 		chain := utils.FormatChainName(conf.Name, args.ContainerID)
 		comment := utils.FormatComment(conf.Name, args.ContainerID)
 		for _, ipc := range containerIPs {
-			// always assuming ipv4
-			if err = ip.SetupIPMasq(&net.IPNet{IP: ipc, Mask: net.CIDRMask(32, 32)}, chain, comment); err != nil {
+			if err = setupIPMasq(&net.IPNet{IP: ipc, Mask: hostMask(ipc)}, chain, comment, conf.nonMasqueradeNets, snatIP); err != nil {
 				return err
 			}
 		}
 	}
 
-	if err = setupNodePortRule(conf.HostInterface, conf.NodePorts, conf.NodePortMark); err != nil {
+	if conf.blocksInstanceMetadata(args.Args) && containerIPV4 {
+		proxyAddr := ""
+		if conf.InstanceMetadataProxyPort != 0 {
+			hostIP := firstGlobalAddr(hostAddrs, false)
+			if hostIP == nil {
+				return fmt.Errorf("no IPv4 address on %q for the metadata proxy", conf.HostInterface)
+			}
+			proxyAddr = net.JoinHostPort(hostIP.String(), strconv.Itoa(conf.InstanceMetadataProxyPort))
+		}
+		chain := utils.MustFormatChainNameWithPrefix(conf.Name, args.ContainerID, "IMDS-")
+		comment := utils.FormatComment(conf.Name, args.ContainerID)
+		if err = setupMetadataBlock(hostInterface.Name, chain, comment, proxyAddr); err != nil {
+			return fmt.Errorf("failed to block instance metadata: %v", err)
+		}
+	}
+
+	if err = setupNodePortRule(conf.HostInterface, conf.NodePorts, conf.NodePortMark, false); err != nil {
 		return err
 	}
+	if containerIPV6 {
+		if err = setupNodePortRule(conf.HostInterface, conf.NodePorts, conf.NodePortMark, true); err != nil {
+			return err
+		}
+	}
 
 	// Pass through the result for the next plugin
-	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	if err = types.PrintResult(conf.PrevResult, conf.CNIVersion); err != nil {
+		return err
+	}
+	added = true
+	return nil
 }
 
 // cmdCheck is called for CHECK requests
@@ -538,8 +976,32 @@ func cmdDel(args *skel.CmdArgs) error {
 		return fmt.Errorf("couldn't parse config: %w", err)
 	}
 
+	// Remove the policy routing table allocated to this container. This
+	// doesn't require the netns, which may already be gone.
+	tables := &lib.RouteTables{}
+	table, tracked, err := tables.Lookup(args.ContainerID)
+	if err != nil {
+		return fmt.Errorf("couldn't lookup route table: %w", err)
+	}
+	if tracked {
+		if err := nl.FlushRouteTable(table); err != nil {
+			return fmt.Errorf("couldn't flush route table %d: %w", table, err)
+		}
+		if err := tables.Release(args.ContainerID); err != nil {
+			return fmt.Errorf("couldn't release route table %d: %w", table, err)
+		}
+	}
+
+	if conf.BlockInstanceMetadata {
+		chain := utils.MustFormatChainNameWithPrefix(conf.Name, args.ContainerID, "IMDS-")
+		comment := utils.FormatComment(conf.Name, args.ContainerID)
+		if err := teardownMetadataBlock(chain, comment); err != nil {
+			return fmt.Errorf("couldn't remove instance metadata rules: %w", err)
+		}
+	}
+
 	if !conf.IPMasq {
-		// we don't have to do anything if IPMasq is false.
+		// we don't have to do anything else if IPMasq is false.
 		return nil
 	}
 
@@ -551,7 +1013,7 @@ func cmdDel(args *skel.CmdArgs) error {
 	// so don't return an error if the device is already removed.
 	// If the device isn't there then don't try to clean up IP masq either.
 	var (
-		addrs         []netlink.Addr
+		addrs         []net.IP
 		vethPeerIndex = -1
 	)
 	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
@@ -563,17 +1025,31 @@ func cmdDel(args *skel.CmdArgs) error {
 			return fmt.Errorf("failed to lookup %q: %v", conf.ContainerInterface, err)
 		}
 
-		// now we grab the iface to get the proper container addrs
-		iface, err := netlink.LinkByName(args.IfName)
+		// now we grab the addrs of every ipvlan interface, as ADD
+		// masquerades the IPs of all of them
+		links, err := netlink.LinkList()
 		if err != nil {
-			return fmt.Errorf("couldn't load link by name %s: %w", args.IfName, err)
+			return fmt.Errorf("couldn't list links: %w", err)
 		}
-		// only care about errors in ipv4 space
-		addrs, err = netlink.AddrList(iface, netlink.FAMILY_V4)
-		if err != nil || len(addrs) == 0 {
-			return fmt.Errorf("couldn't discover addrs from iface: %s: %w", args.IfName, err)
+		for _, link := range links {
+			if link.Type() != "ipvlan" {
+				continue
+			}
+			linkAddrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+			if err != nil {
+				return fmt.Errorf("couldn't discover addrs from iface: %s: %w", link.Attrs().Name, err)
+			}
+			// link-local addresses are never masqueraded
+			for _, addr := range linkAddrs {
+				if !addr.IP.IsLinkLocalUnicast() {
+					addrs = append(addrs, addr.IP)
+				}
+			}
 		}
-		return err
+		if len(addrs) == 0 {
+			return fmt.Errorf("couldn't discover addrs from iface: %s", args.IfName)
+		}
+		return nil
 	})
 	if err != nil {
 		return fmt.Errorf("couldn't discover peer idx from netns %s: %w", args.Netns, err)
@@ -581,9 +1057,21 @@ func cmdDel(args *skel.CmdArgs) error {
 
 	chain := utils.FormatChainName(conf.Name, args.ContainerID)
 	comment := utils.FormatComment(conf.Name, args.ContainerID)
-	for _, ipn := range addrs {
-		// always assume ipv4, since those are the IPs we filter for
-		if err := ip.TeardownIPMasq(&net.IPNet{IP: ipn.IP, Mask: net.CIDRMask(32, 32)}, chain, comment); err != nil {
+	for _, ipv6 := range []bool{false, true} {
+		var family []net.IP
+		for _, addr := range addrs {
+			if (addr.To4() == nil) == ipv6 {
+				family = append(family, addr)
+			}
+		}
+		if len(family) == 0 {
+			continue
+		}
+		ipt, err := iptables.NewWithProtocol(iptablesProtocol(ipv6))
+		if err != nil {
+			return fmt.Errorf("failed to locate iptables: %v", err)
+		}
+		if err := teardownIPMasq(ipt, family, chain, comment); err != nil {
 			return fmt.Errorf("couldn't teardown ip masq: %w", err)
 		}
 	}
@@ -593,11 +1081,15 @@ func cmdDel(args *skel.CmdArgs) error {
 		if err != nil {
 			return fmt.Errorf("couldn't find link by index %d: %w", vethPeerIndex, err)
 		}
-		rule := netlink.NewRule()
-		rule.IifName = link.Attrs().Name
-
-		if err := netlink.RuleDel(rule); err != nil {
-			return fmt.Errorf("couldn't delete rule %s: %w", rule.IifName, err)
+		// Rules created before route tables were tracked are only
+		// known by their incoming interface
+		if !tracked {
+			rule := netlink.NewRule()
+			rule.IifName = link.Attrs().Name
+
+			if err := netlink.RuleDel(rule); err != nil {
+				return fmt.Errorf("couldn't delete rule %s: %w", rule.IifName, err)
+			}
 		}
 		if err := netlink.LinkDel(link); err != nil {
 			return fmt.Errorf("couldn't delete link %s: %w", link.Attrs().Name, err)
@@ -608,6 +1100,5 @@ func cmdDel(args *skel.CmdArgs) error {
 }
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "unnumbered-ptp")
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeNAT is a nat table holding masquerading chains and the
+// POSTROUTING jumps to them
+type fakeNAT struct {
+	jumps  map[string]bool
+	chains map[string]bool
+}
+
+func (f *fakeNAT) Delete(table, chain string, rulespec ...string) error {
+	delete(f.jumps, strings.Join(rulespec, " "))
+	return nil
+}
+
+func (f *fakeNAT) ClearChain(table, chain string) error {
+	f.chains[chain] = true
+	return nil
+}
+
+func (f *fakeNAT) DeleteChain(table, chain string) error {
+	for jump := range f.jumps {
+		if strings.Contains(jump, "-j "+chain+" ") {
+			return fmt.Errorf("chain %v in use by %v", chain, jump)
+		}
+	}
+	delete(f.chains, chain)
+	return nil
+}
+
+func TestTeardownIPMasq(t *testing.T) {
+	chain, comment := "CNI-abc", "name: test id: abc"
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1")}
+	nat := &fakeNAT{jumps: map[string]bool{}, chains: map[string]bool{chain: true}}
+	for _, addr := range ips {
+		nat.jumps[fmt.Sprintf("-s %v -j %v -m comment --comment %v", addr, chain, comment)] = true
+	}
+
+	// Both Pod IPs jump to the same chain
+	if err := teardownIPMasq(nat, ips, chain, comment); err != nil {
+		t.Fatalf("teardown failed %v", err)
+	}
+	if len(nat.jumps) != 0 || len(nat.chains) != 0 {
+		t.Fatalf("expected no rules left, got %v %v", nat.jumps, nat.chains)
+	}
+}
+
+func TestBlocksInstanceMetadata(t *testing.T) {
+	cases := []struct {
+		Conf    string
+		CNIArgs string
+		Blocks  bool
+	}{
+		{`{}`, "", false},
+		{`{"blockInstanceMetadata": true}`, "", true},
+		{`{"blockInstanceMetadata": true, "args": {"cni": {"allowInstanceMetadata": true}}}`, "", false},
+		// kubelet only passes the Pod namespace and name
+		{`{"blockInstanceMetadata": true, "instanceMetadataNamespaces": ["kube-system"]}`,
+			"IgnoreUnknown=1;K8S_POD_NAMESPACE=kube-system;K8S_POD_NAME=proxy", false},
+		{`{"blockInstanceMetadata": true, "instanceMetadataNamespaces": ["kube-system"]}`,
+			"IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=app", true},
+	}
+
+	for _, c := range cases {
+		conf := &PluginConf{}
+		if err := json.Unmarshal([]byte(c.Conf), conf); err != nil {
+			t.Fatalf("invalid config %v: %v", c.Conf, err)
+		}
+		if blocks := conf.blocksInstanceMetadata(c.CNIArgs); blocks != c.Blocks {
+			t.Errorf("expected %v to block %v, got %v", c.Conf, c.Blocks, blocks)
+		}
+	}
+}